@@ -0,0 +1,177 @@
+// Package auth holds the users of a cluster and checks their passwords,
+// either sent in the clear with SASL PLAIN or proven with SCRAM-SHA
+// (rfc 5802). Only salted keys are kept, never the passwords.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Roles, each allows everything the ones before it do
+const (
+	Read      = "read"      // get and stats
+	ReadWrite = "readwrite" // sets and deletes
+	Admin     = "admin"     // flush, snapshots and vbucket moves
+)
+
+var rank = map[string]int{Read: 1, ReadWrite: 2, Admin: 3}
+
+// a role given for AllBuckets applies to every bucket without a role of
+// its own
+const AllBuckets = "*"
+
+// NodeUser is the user nodes and cluster managers log in as when talking
+// to each other, with the password shared by the whole cluster
+const NodeUser = "@node"
+
+// Mechanisms offered to clients, best first
+const Mechanisms = "SCRAM-SHA512 SCRAM-SHA256 PLAIN"
+
+// PBKDF2 iterations of new passwords
+var Iterations = 4096
+
+var ErrAuth = errors.New("authentication failed")
+
+// secret of this process, made up salts of unknown users are derived from
+// it and logins are cached under it
+var secret = make([]byte, 32)
+
+func init() {
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+}
+
+// A User has a role per bucket and the keys derived from the password
+// for each SCRAM hash
+type User struct {
+	Roles      map[string]string `json:"roles"`
+	Salt       []byte            `json:"salt"`
+	Iterations int               `json:"iterations"`
+	SHA256     Keys              `json:"sha256"`
+	SHA512     Keys              `json:"sha512"`
+}
+
+type Keys struct {
+	StoredKey []byte `json:"stored_key"`
+	ServerKey []byte `json:"server_key"`
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return rank[role] > 0
+}
+
+// NewUser creates a user with a freshly salted password
+func NewUser(password string, roles map[string]string) (*User, error) {
+	u := &User{Roles: roles}
+	if err := u.SetPassword(password); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *User) SetPassword(password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	u.Salt = salt
+	u.Iterations = Iterations
+	u.SHA256 = deriveKeys(password, salt, Iterations, sha256.New)
+	u.SHA512 = deriveKeys(password, salt, Iterations, sha512.New)
+	return nil
+}
+
+func deriveKeys(password string, salt []byte, iterations int, h func() hash.Hash) Keys {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, h().Size(), h)
+	clientKey := hmacSum(h, salted, []byte("Client Key"))
+	return Keys{
+		StoredKey: hashSum(h, clientKey),
+		ServerKey: hmacSum(h, salted, []byte("Server Key")),
+	}
+}
+
+// CheckPassword reports whether password is the user's password
+func (u *User) CheckPassword(password string) bool {
+	k := deriveKeys(password, u.Salt, u.Iterations, sha256.New)
+	return subtle.ConstantTimeCompare(k.StoredKey, u.SHA256.StoredKey) == 1
+}
+
+// maxLogins is how many logins a Logins cache holds before starting over
+const maxLogins = 1024
+
+// Logins caches passwords that checked out, for clients that log in on
+// every request like the REST apis, so they don't pay for PBKDF2 each
+// time. Passwords are kept as an hmac under the process secret, each
+// with the key it was checked against so a new password drops it.
+type Logins struct {
+	lock sync.Mutex
+	ok   map[string][]byte
+}
+
+// CheckPassword reports whether password is the password of user u
+// logging in as name
+func (l *Logins) CheckPassword(name string, u *User, password string) bool {
+	key := string(hmacSum(sha256.New, secret, []byte(name+"\x00"+password)))
+	l.lock.Lock()
+	stored, ok := l.ok[key]
+	l.lock.Unlock()
+	if ok && subtle.ConstantTimeCompare(stored, u.SHA256.StoredKey) == 1 {
+		return true
+	}
+	if !u.CheckPassword(password) {
+		return false
+	}
+	l.lock.Lock()
+	if l.ok == nil || len(l.ok) >= maxLogins {
+		l.ok = make(map[string][]byte)
+	}
+	l.ok[key] = u.SHA256.StoredKey
+	l.lock.Unlock()
+	return true
+}
+
+// Role returns the user's role on bucket, "" if it has none
+func (u *User) Role(bucket string) string {
+	if r, ok := u.Roles[bucket]; ok {
+		return r
+	}
+	return u.Roles[AllBuckets]
+}
+
+// Allowed reports whether the user's role on bucket includes role
+func (u *User) Allowed(bucket, role string) bool {
+	return rank[u.Role(bucket)] >= rank[role]
+}
+
+// Plain parses the body of a SASL PLAIN request, "authzid\0user\0password"
+func Plain(body []byte) (user, password string, err error) {
+	parts := strings.Split(string(body), "\x00")
+	if len(parts) != 3 || parts[1] == "" {
+		return "", "", errors.New("malformed PLAIN request")
+	}
+	return parts[1], parts[2], nil
+}
+
+func hmacSum(h func() hash.Hash, key, msg []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+func hashSum(h func() hash.Hash, msg []byte) []byte {
+	d := h()
+	d.Write(msg)
+	return d.Sum(nil)
+}
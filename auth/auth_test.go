@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/couchbase/goutils/scramsha"
+)
+
+func TestPlain(t *testing.T) {
+	u, err := NewUser("secret", map[string]string{"default": ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, password, err := Plain([]byte("\x00alice\x00secret"))
+	if err != nil || name != "alice" || password != "secret" {
+		t.Fatalf("bad PLAIN parse %q %q %v", name, password, err)
+	}
+	if !u.CheckPassword(password) {
+		t.Errorf("password not accepted")
+	}
+	if u.CheckPassword("wrong") {
+		t.Errorf("wrong password accepted")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	u := &User{Roles: map[string]string{"default": ReadWrite, AllBuckets: Read}}
+
+	if !u.Allowed("default", Read) || !u.Allowed("default", ReadWrite) || u.Allowed("default", Admin) {
+		t.Errorf("wrong access to default with role %s", u.Role("default"))
+	}
+	if !u.Allowed("other", Read) || u.Allowed("other", ReadWrite) {
+		t.Errorf("wrong access to other with role %s", u.Role("other"))
+	}
+
+	u = &User{Roles: map[string]string{"default": Admin}}
+	if u.Role("other") != "" || u.Allowed("other", Read) {
+		t.Errorf("access to a bucket without a role")
+	}
+}
+
+// run an exchange against the client used by gomemcached
+func scramLogin(t *testing.T, mech, name, password string, users map[string]*User) error {
+	c, err := scramsha.NewScramSha(mech)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewScram(mech)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := c.GetStartRequest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverFirst, err := s.Start([]byte(first), func(n string) *User { return users[n] })
+	if err != nil {
+		return err
+	}
+	if err := c.HandleStartResponse(string(serverFirst)); err != nil {
+		t.Fatal(err)
+	}
+	serverFinal, err := s.Finish([]byte(c.GetFinalRequest(password)))
+	if err != nil {
+		return err
+	}
+	if err := c.HandleFinalResponse(string(serverFinal)); err != nil {
+		t.Errorf("client rejected the server signature: %v", err)
+	}
+	if s.User() != name {
+		t.Errorf("logged in as %q, expected %q", s.User(), name)
+	}
+	return nil
+}
+
+func TestScram(t *testing.T) {
+	u, err := NewUser("secret", map[string]string{AllBuckets: Admin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]*User{"bob": u}
+
+	for _, mech := range []string{"SCRAM-SHA256", "SCRAM-SHA512"} {
+		if err := scramLogin(t, mech, "bob", "secret", users); err != nil {
+			t.Errorf("%s: login failed: %v", mech, err)
+		}
+		if err := scramLogin(t, mech, "bob", "wrong", users); err != ErrAuth {
+			t.Errorf("%s: wrong password gave %v", mech, err)
+		}
+		if err := scramLogin(t, mech, "nobody", "secret", users); err != ErrAuth {
+			t.Errorf("%s: unknown user gave %v", mech, err)
+		}
+	}
+}
+
+func TestLogins(t *testing.T) {
+	u, err := NewUser("secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l Logins
+	for i := 0; i < 2; i++ {
+		if !l.CheckPassword("bob", u, "secret") || l.CheckPassword("bob", u, "wrong") {
+			t.Errorf("check %d of bob's password", i)
+		}
+	}
+	u.SetPassword("changed")
+	if l.CheckPassword("bob", u, "secret") || !l.CheckPassword("bob", u, "changed") {
+		t.Errorf("old password still accepted")
+	}
+}
+
+// an unknown user gets the same salt every time, like a known one
+func TestScramUnknownSalt(t *testing.T) {
+	salt := func() string {
+		s, _ := NewScram("SCRAM-SHA256")
+		first, err := s.Start([]byte("n,,n=nobody,r=abc"), func(string) *User { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseAttrs(string(first))["s"]
+	}
+	if a, b := salt(), salt(); a != b {
+		t.Errorf("salts %s and %s", a, b)
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Scram is the server side of one SCRAM-SHA exchange. The client sends
+// its user and nonce, gets back the salt and iteration count, and proves
+// it knows the password with a proof computed over the whole exchange.
+type Scram struct {
+	hash  func() hash.Hash
+	name  string
+	user  *User
+	nonce string
+	gs2   string // channel binding header
+	auth  string // messages so far, as signed by both sides
+}
+
+// NewScram starts an exchange for mech, SCRAM-SHA256 or SCRAM-SHA512
+func NewScram(mech string) (*Scram, error) {
+	switch mech {
+	case "SCRAM-SHA256":
+		return &Scram{hash: sha256.New}, nil
+	case "SCRAM-SHA512":
+		return &Scram{hash: sha512.New}, nil
+	}
+	return nil, fmt.Errorf("unsupported mechanism %s", mech)
+}
+
+// User returns the name the client logged in with
+func (s *Scram) User() string {
+	return s.name
+}
+
+func (s *Scram) keys() Keys {
+	if s.user == nil {
+		return Keys{}
+	}
+	if s.hash().Size() == sha512.Size {
+		return s.user.SHA512
+	}
+	return s.user.SHA256
+}
+
+// Start takes the client's first message, "n,,n=user,r=nonce", and
+// returns the server's. lookup returns nil for unknown users, they get a
+// made up salt, the same every time so it doesn't give them away, and fail
+// in Finish
+func (s *Scram) Start(clientFirst []byte, lookup func(name string) *User) ([]byte, error) {
+	msg := string(clientFirst)
+	if !strings.HasPrefix(msg, "n,,") && !strings.HasPrefix(msg, "y,,") {
+		return nil, errors.New("channel binding is not supported")
+	}
+	s.gs2 = msg[:3]
+	bare := msg[3:]
+
+	attrs := parseAttrs(bare)
+	name, cnonce := attrs["n"], attrs["r"]
+	if name == "" || cnonce == "" {
+		return nil, errors.New("malformed client first message")
+	}
+	s.name = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+	s.user = lookup(s.name)
+
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.nonce = cnonce + base64.StdEncoding.EncodeToString(nonce)
+
+	salt, iterations := hmacSum(sha256.New, secret, []byte(s.name))[:16], Iterations
+	if s.user != nil {
+		salt, iterations = s.user.Salt, s.user.Iterations
+	}
+
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", s.nonce, base64.StdEncoding.EncodeToString(salt), iterations)
+	s.auth = bare + "," + serverFirst
+	return []byte(serverFirst), nil
+}
+
+// Finish checks the client's proof in "c=biws,r=nonce,p=proof" and
+// returns the server's signature, proving to the client that the server
+// knows the password too
+func (s *Scram) Finish(clientFinal []byte) ([]byte, error) {
+	msg := string(clientFinal)
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, errors.New("malformed client final message")
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, errors.New("malformed client proof")
+	}
+
+	attrs := parseAttrs(withoutProof)
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2)) || attrs["r"] != s.nonce {
+		return nil, ErrAuth
+	}
+	s.auth += "," + withoutProof
+
+	keys := s.keys()
+	if s.user == nil || len(proof) != len(keys.StoredKey) {
+		return nil, ErrAuth
+	}
+	signature := hmacSum(s.hash, keys.StoredKey, []byte(s.auth))
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	if subtle.ConstantTimeCompare(hashSum(s.hash, clientKey), keys.StoredKey) != 1 {
+		return nil, ErrAuth
+	}
+
+	serverSignature := hmacSum(s.hash, keys.ServerKey, []byte(s.auth))
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// attributes of a SCRAM message, "a=1,b=2"
+func parseAttrs(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			attrs[kv[:1]] = kv[2:]
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,455 @@
+package main
+
+// bulk loads items into a node from JSON lines or CSV with quiet SETs
+// pipelined over several connections, or exports the items of the nodes
+// to a JSON lines file, each node's items as of one snapshot.
+//
+//	bulk -load items.jsonl -threads 8 -port 11212
+//	bulk -load items.csv -header
+//	bulk -export items.jsonl -http localhost:8080,localhost:8081
+//
+// A JSON line is {"key":"k","value":"v","exp":1760000000}, the format the
+// export and -shutdownSnapshot write. A value that is not a string is
+// stored as its JSON text, keys and values are decoded from base64 when
+// "base64" is true. A CSV row is key,value[,exp]. exp follows memcached,
+// seconds from now up to 30 days and a unix time above that
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
+)
+
+var server = flag.String("server", "localhost", "server URL")
+var port = flag.Int("port", 11212, "server port")
+var user = flag.String("user", "", "user to log in as")
+var password = flag.String("password", "", "password of the user")
+var bucket = flag.String("bucket", "", "bucket to load into or export, the default one if empty")
+
+var loadFile = flag.String("load", "", "file to load, - for stdin")
+var format = flag.String("format", "", "format of -load, json or csv, from the file's extension if empty")
+var header = flag.Bool("header", false, "skip the first row of a CSV file")
+var threadCount = flag.Int("threads", 8, "no. of connections loading at once")
+var batchSize = flag.Int("batch", 100, "no. of quiet sets sent before waiting for their errors")
+
+var exportFile = flag.String("export", "", "file to export to, - for stdout")
+var httpNodes = flag.String("http", "localhost:8080", "REST api (-httpPort) of every node to export, comma separated")
+var pageSize = flag.Int("page", 1000, "no. of items fetched per request when exporting")
+
+// an item as the REST api lists it
+type item struct {
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value"`
+	Exp    uint32          `json:"exp,omitempty"`
+	Base64 bool            `json:"base64,omitempty"`
+}
+
+type record struct {
+	line  int
+	key   []byte
+	value []byte
+	exp   uint32
+}
+
+var loaded, failed, skipped uint64
+
+func main() {
+	flag.Parse()
+	if (*loadFile == "") == (*exportFile == "") {
+		log.Fatalf("give one of -load or -export")
+	}
+
+	start := time.Now()
+	if *loadFile != "" {
+		load()
+		elapsed := time.Since(start)
+		log.Printf("loaded %d items in %v (%.0f/sec), %d failed, %d lines skipped",
+			loaded, elapsed, float64(loaded)/elapsed.Seconds(), failed, skipped)
+		if failed > 0 || skipped > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	n, err := export(*exportFile)
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	log.Printf("exported %d items in %v", n, time.Since(start))
+}
+
+func load() {
+	var in io.Reader = os.Stdin
+	if *loadFile != "-" {
+		f, err := os.Open(*loadFile)
+		if err != nil {
+			log.Fatalf("Unable to open %v: %v", *loadFile, err)
+		}
+		defer f.Close()
+		in = f
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.EqualFold(filepath.Ext(*loadFile), ".csv") {
+			*format = "csv"
+		}
+	}
+
+	var read func(r io.Reader, records chan<- record) error
+	switch *format {
+	case "json":
+		read = readJSON
+	case "csv":
+		read = readCSV
+	default:
+		log.Fatalf("Unknown format %v", *format)
+	}
+
+	// connect first, a bad address or password should not read the file
+	var conns []*memcached.Client
+	for j := 0; j < *threadCount; j++ {
+		mc, err := connect()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		conns = append(conns, mc)
+	}
+	log.Printf(" Connected to server %s:%d", *server, *port)
+
+	records := make(chan record, *threadCount**batchSize)
+	var wg sync.WaitGroup
+	for _, mc := range conns {
+		wg.Add(1)
+		go func(mc *memcached.Client) {
+			defer wg.Done()
+			if err := loadWorker(mc, records); err != nil {
+				log.Fatalf("Load failed: %v", err)
+			}
+		}(mc)
+	}
+
+	err := read(bufio.NewReaderSize(in, 1<<20), records)
+	close(records)
+	wg.Wait()
+	if err != nil {
+		log.Fatalf("Reading %v failed: %v", *loadFile, err)
+	}
+}
+
+func connect() (*memcached.Client, error) {
+	memServer := fmt.Sprintf("%s:%d", *server, *port)
+	mc, err := memcached.Connect("tcp", memServer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %v, error %v", memServer, err)
+	}
+	if *user != "" {
+		if _, err := mc.AuthScramSha(*user, *password); err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("Unable to log in as %v, error %v", *user, err)
+		}
+	}
+	if *bucket != "" {
+		if _, err := mc.SelectBucket(*bucket); err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("Unable to select bucket %v, error %v", *bucket, err)
+		}
+	}
+	return mc, nil
+}
+
+func skip(line int, format string, args ...interface{}) {
+	atomic.AddUint64(&skipped, 1)
+	log.Printf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func readJSON(r io.Reader, records chan<- record) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 1<<20), 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Bytes()
+		if len(strings.TrimSpace(string(text))) == 0 {
+			continue
+		}
+		var itm item
+		if err := json.Unmarshal(text, &itm); err != nil {
+			skip(line, "%v", err)
+			continue
+		}
+		if itm.Key == "" {
+			skip(line, "no key")
+			continue
+		}
+
+		rec := record{line: line, key: []byte(itm.Key), value: itm.Value, exp: itm.Exp}
+		var s string
+		if len(itm.Value) > 0 && itm.Value[0] == '"' {
+			json.Unmarshal(itm.Value, &s)
+			rec.value = []byte(s)
+		} else if string(itm.Value) == "null" {
+			rec.value = nil
+		}
+		if itm.Base64 {
+			key, err := base64.StdEncoding.DecodeString(itm.Key)
+			if err != nil {
+				skip(line, "key is not base64: %v", err)
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				skip(line, "value is not base64: %v", err)
+				continue
+			}
+			rec.key, rec.value = key, value
+		}
+		records <- rec
+	}
+	return sc.Err()
+}
+
+func readCSV(r io.Reader, records chan<- record) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	if *header {
+		if _, err := cr.Read(); err != nil && err != io.EOF {
+			return err
+		}
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if pe, ok := err.(*csv.ParseError); ok {
+			skip(pe.Line, "%v", pe.Err)
+			continue
+		} else if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(row) < 2 || len(row) > 3 || row[0] == "" {
+			skip(line, "want key,value[,exp], got %d fields", len(row))
+			continue
+		}
+		rec := record{line: line, key: []byte(row[0]), value: []byte(row[1])}
+		if len(row) == 3 && row[2] != "" {
+			exp, err := strconv.ParseUint(row[2], 10, 32)
+			if err != nil {
+				skip(line, "bad exp %q", row[2])
+				continue
+			}
+			rec.exp = uint32(exp)
+		}
+		records <- rec
+	}
+}
+
+// loadWorker sends batches of SETQ followed by a NOOP. Only failed sets
+// are answered, so every response before the NOOP's is an error for the
+// record its opaque points at
+func loadWorker(mc *memcached.Client, records <-chan record) error {
+	conn := mc.Hijack()
+	defer conn.Close()
+	w := bufio.NewWriterSize(conn, 64<<10)
+	r := bufio.NewReaderSize(conn, 64<<10)
+	hdr := make([]byte, gomemcached.HDR_LEN)
+
+	batch := make([]record, 0, *batchSize)
+	send := func() error {
+		for i, rec := range batch {
+			req := &gomemcached.MCRequest{
+				Opcode: gomemcached.SETQ,
+				Key:    rec.key,
+				Body:   rec.value,
+				Extras: make([]byte, 8),
+				Opaque: uint32(i),
+			}
+			binary.BigEndian.PutUint32(req.Extras[4:], rec.exp)
+			if _, err := req.Transmit(w); err != nil {
+				return err
+			}
+		}
+		noop := &gomemcached.MCRequest{Opcode: gomemcached.NOOP, Opaque: uint32(len(batch))}
+		if _, err := noop.Transmit(w); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		errs := 0
+		for {
+			res := &gomemcached.MCResponse{}
+			if _, err := res.Receive(r, hdr); err != nil {
+				return err
+			}
+			if res.Opcode == gomemcached.NOOP {
+				break
+			}
+			if int(res.Opaque) >= len(batch) {
+				return errors.New("response for an unknown request")
+			}
+			errs++
+			rec := batch[res.Opaque]
+			log.Printf("line %d: set of %q failed: %v %s", rec.line, rec.key, res.Status, res.Body)
+		}
+		atomic.AddUint64(&failed, uint64(errs))
+		atomic.AddUint64(&loaded, uint64(len(batch)-errs))
+		batch = batch[:0]
+		return nil
+	}
+
+	for rec := range records {
+		batch = append(batch, rec)
+		if len(batch) == *batchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return send()
+	}
+	return nil
+}
+
+// export writes the items of every node to path, going through a
+// temporary file so a failed export leaves nothing behind
+func export(path string) (int, error) {
+	out := os.Stdout
+	if path != "-" {
+		f, err := os.Create(path + ".tmp")
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(path + ".tmp")
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+
+	total := 0
+	for _, node := range strings.Split(*httpNodes, ",") {
+		node = strings.TrimSpace(node)
+		if !strings.Contains(node, "://") {
+			node = "http://" + node
+		}
+		n, err := exportNode(strings.TrimRight(node, "/"), w)
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", node, err)
+		}
+		log.Printf(" exported %d items from %s", n, node)
+		total += n
+	}
+
+	if err := w.Flush(); err != nil {
+		return total, err
+	}
+	if path == "-" {
+		return total, nil
+	}
+	if err := out.Close(); err != nil {
+		return total, err
+	}
+	return total, os.Rename(path+".tmp", path)
+}
+
+var httpClient = &http.Client{Timeout: time.Minute}
+
+// call sends a request to the REST api of a node and decodes its answer
+// into v unless v is nil
+func call(method, u string, v interface{}) error {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if *user != "" {
+		req.SetBasicAuth(*user, *password)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, u, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// exportNode takes a snapshot on the node and pages through the items it
+// owns as of that snapshot, closing the snapshot at the end
+func exportNode(node string, w io.Writer) (int, error) {
+	q := url.Values{}
+	if *bucket != "" {
+		q.Set("bucket", *bucket)
+	}
+
+	var snap struct {
+		Snapshot uint32 `json:"snapshot"`
+	}
+	if err := call("POST", node+"/snapshots?"+q.Encode(), &snap); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := call("DELETE", fmt.Sprintf("%s/snapshots/%d?%s", node, snap.Snapshot, q.Encode()), nil); err != nil {
+			log.Printf("Unable to close snapshot %d: %v", snap.Snapshot, err)
+		}
+	}()
+
+	q.Set("snapshot", fmt.Sprint(snap.Snapshot))
+	q.Set("limit", fmt.Sprint(*pageSize))
+	n := 0
+	for {
+		var page struct {
+			Items      []json.RawMessage `json:"items"`
+			Next       string            `json:"next"`
+			NextBase64 bool              `json:"nextBase64"`
+		}
+		if err := call("GET", node+"/kv?"+q.Encode(), &page); err != nil {
+			return n, err
+		}
+		for _, itm := range page.Items {
+			w.Write(itm)
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if page.Next == "" {
+			return n, nil
+		}
+		q.Set("start", page.Next)
+		q.Set("base64", fmt.Sprint(page.NextBase64))
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/server"
+)
+
+// a node taking sets over the binary protocol and listing its items over
+// the REST api, with at most one snapshot at a time
+type fakeNode struct {
+	lock   sync.Mutex
+	items  map[string]record
+	snap   map[string]record
+	closed bool
+}
+
+func (n *fakeNode) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.NOOP:
+		return &gomemcached.MCResponse{}
+	case gomemcached.SETQ:
+		if string(req.Body) == "bad" {
+			return &gomemcached.MCResponse{Status: gomemcached.E2BIG}
+		}
+		n.lock.Lock()
+		n.items[string(req.Key)] = record{key: req.Key, value: req.Body, exp: binary.BigEndian.Uint32(req.Extras[4:])}
+		n.lock.Unlock()
+		return nil
+	}
+	return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	switch {
+	case req.Method == "POST" && req.URL.Path == "/snapshots":
+		n.snap = make(map[string]record)
+		for k, rec := range n.items {
+			n.snap[k] = rec
+		}
+		fmt.Fprint(w, `{"snapshot":7}`)
+	case req.Method == "DELETE" && req.URL.Path == "/snapshots/7":
+		n.closed = true
+	case req.URL.Path == "/kv" && req.FormValue("snapshot") == "7":
+		var keys []string
+		for k := range n.snap {
+			if k >= req.FormValue("start") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var limit int
+		fmt.Sscan(req.FormValue("limit"), &limit)
+		var page struct {
+			Items []item `json:"items"`
+			Next  string `json:"next,omitempty"`
+		}
+		if len(keys) > limit {
+			page.Next = keys[limit]
+			keys = keys[:limit]
+		}
+		for _, k := range keys {
+			rec := n.snap[k]
+			itm := item{Key: k, Exp: rec.exp}
+			value := string(rec.value)
+			if !utf8.ValidString(k) || !utf8.ValidString(value) {
+				itm.Key = base64.StdEncoding.EncodeToString(rec.key)
+				value = base64.StdEncoding.EncodeToString(rec.value)
+				itm.Base64 = true
+			}
+			itm.Value, _ = json.Marshal(value)
+			page.Items = append(page.Items, itm)
+		}
+		json.NewEncoder(w).Encode(page)
+	default:
+		http.Error(w, `{"error":"not found"}`, http.StatusNotFound)
+	}
+}
+
+func readAll(t *testing.T, read func(io.Reader, chan<- record) error, in string) []record {
+	records := make(chan record, 100)
+	if err := read(strings.NewReader(in), records); err != nil {
+		t.Fatal(err)
+	}
+	close(records)
+	var recs []record
+	for rec := range records {
+		rec.line = 0
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestReadCSV(t *testing.T) {
+	skipped = 0
+	*header = true
+	defer func() { *header = false }()
+
+	recs := readAll(t, readCSV, "key,value,exp\na,1\nb,\"x,y\",60\nc\nd,2,soon\ne,3,\n")
+	want := []record{
+		{key: []byte("a"), value: []byte("1")},
+		{key: []byte("b"), value: []byte("x,y"), exp: 60},
+		{key: []byte("e"), value: []byte("3")},
+	}
+	if !reflect.DeepEqual(recs, want) || skipped != 2 {
+		t.Errorf("read %+v with %d skipped", recs, skipped)
+	}
+}
+
+// items loaded from a file and exported again come out the same, whatever
+// page they are listed on
+func TestLoadExport(t *testing.T) {
+	node := &fakeNode{items: make(map[string]record)}
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	go func() {
+		for {
+			c, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go memcached.HandleIO(c, node)
+		}
+	}()
+	srv := httptest.NewServer(node)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binKey := base64.StdEncoding.EncodeToString([]byte{0xff, 0})
+	binValue := base64.StdEncoding.EncodeToString([]byte{1, 0xfe})
+	in := strings.Join([]string{
+		`{"key":"plain","value":"v"}`,
+		`{"key":"expiring","value":"e","exp":1900000000}`,
+		`{"key":"json","value":{"a":[1,2]}}`,
+		`{"key":"number","value":42}`,
+		`{"key":"` + binKey + `","value":"` + binValue + `","base64":true}`,
+		``,
+		`{"key":"broken"`,
+		`{"value":"no key"}`,
+		`{"key":"not base64","value":"v","base64":true}`,
+		`{"key":"failing","value":"bad"}`,
+	}, "\n")
+	loadPath := filepath.Join(dir, "in.jsonl")
+	ioutil.WriteFile(loadPath, []byte(in), 0644)
+
+	*server, *port = "127.0.0.1", ls.Addr().(*net.TCPAddr).Port
+	*loadFile, *threadCount, *batchSize = loadPath, 2, 2
+	loaded, failed, skipped = 0, 0, 0
+	load()
+	if loaded != 5 || failed != 1 || skipped != 3 {
+		t.Errorf("loaded %d, failed %d, skipped %d", loaded, failed, skipped)
+	}
+
+	*httpNodes, *pageSize = srv.URL, 2
+	exportPath := filepath.Join(dir, "out.jsonl")
+	n, err := export(exportPath)
+	if err != nil || n != 5 {
+		t.Fatalf("exported %d items: %v", n, err)
+	}
+	if !node.closed {
+		t.Errorf("snapshot not closed")
+	}
+
+	out, _ := ioutil.ReadFile(exportPath)
+	got := readAll(t, readJSON, string(out))
+	want := readAll(t, readJSON, in)
+	want = want[:len(want)-1]
+	sort.Slice(want, func(i, j int) bool { return string(want[i].key) < string(want[j].key) })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exported %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(exportPath + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+}
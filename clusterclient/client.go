@@ -1,27 +1,91 @@
 package client
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/maniktaneja/luxstor/auth"
 )
 
+// number of vbuckets keys are hashed to
+const VbucketCount = 2
+
+// bucket connections start out in
+const DefaultBucket = "default"
+
+// TLSConfig is used to talk to https cluster managers
+var TLSConfig *tls.Config
+
+// Password the node user logs in to the cluster managers with, the users'
+// keys are only served to nodes that log in. None if empty
+var NodePassword = ""
+
+// How long the cluster manager may hold a map request waiting for a newer
+// revision
+var LongPollWait = 30 * time.Second
+
 type Map struct {
 	Node struct {
 		ServerList string `json:"serverList"`
 		LuxMap     string `json:"luxMap"`
 	} `json:"nodes"`
+	Buckets map[string]Bucket     `json:"buckets"`
+	Users   map[string]*auth.User `json:"users"`
+	Term    uint64                `json:"term"`
+	Rev     uint64                `json:"rev"`
+}
+
+// A bucket's vbucket map and settings. Quota is the memory, in bytes, a
+// node may use for the bucket, 0 for no limit
+type Bucket struct {
+	LuxMap   string `json:"luxmap"`
+	Quota    uint64 `json:"quota"`
+	Replicas int    `json:"replicas"`
 }
 
-var nodeMap string
+var (
+	mapLock    sync.RWMutex
+	buckets    = make(map[string]Bucket)
+	users      map[string]*auth.User
+	mapTerm    uint64
+	mapRev     uint64
+	mapChanged = make(chan bool) // closed when a new map is accepted
+)
+
+// ParseManagers splits a comma separated list of cluster manager urls
+func ParseManagers(list string) []string {
+	var managers []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			managers = append(managers, u)
+		}
+	}
+	return managers
+}
 
-func RunClient(clusterURL string) {
-	for {
-		resp, err := http.Get(clusterURL)
+// RunClient follows the map published by the cluster managers. Each
+// request asks for a revision newer than the current one and the manager
+// holds it until there is one, so changes are seen as soon as they are
+// published. On errors the last good map is kept and the next manager in
+// the list is tried.
+func RunClient(managers []string) {
+	hc := httpClient(LongPollWait + 10*time.Second)
+	for cur := 0; ; {
+		term, rev := getRevision()
+		u := fmt.Sprintf("%s/nodes?term=%d&rev=%d&wait=%s", managers[cur], term, rev, LongPollWait)
+		resp, err := hc.Get(u)
 		if err != nil {
-			nodeMap = ""
+			log.Printf(" cannot fetch map from %s, keeping rev %d: %v", managers[cur], rev, err)
+			cur = (cur + 1) % len(managers)
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -30,13 +94,178 @@ func RunClient(clusterURL string) {
 		resp.Body.Close()
 
 		var nodes Map
-		json.Unmarshal([]byte(string(body)), &nodes)
-		log.Printf(" got nodes %v", nodes)
-		nodeMap = nodes.Node.LuxMap
+		if err == nil && resp.StatusCode == http.StatusOK {
+			err = json.Unmarshal(body, &nodes)
+		} else if err == nil {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+		if err != nil {
+			log.Printf(" bad map response from %s, keeping rev %d: %v", managers[cur], rev, err)
+			cur = (cur + 1) % len(managers)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		if setMap(nodes) {
+			log.Printf(" got nodes %v", nodes)
+		}
+	}
+}
+
+// only revisions newer than the current one are accepted. A map from a
+// newer manager term wins over any revision of an older term
+func setMap(m Map) bool {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	if m.Term < mapTerm || (m.Term == mapTerm && m.Rev <= mapRev) {
+		return false
+	}
+	if m.Buckets != nil {
+		buckets = m.Buckets
+	} else {
+		// a manager without buckets only has the default one
+		buckets = map[string]Bucket{DefaultBucket: {LuxMap: m.Node.LuxMap}}
+	}
+	users = m.Users
+	mapTerm = m.Term
+	mapRev = m.Rev
+	close(mapChanged)
+	mapChanged = make(chan bool)
+	return true
+}
+
+func httpClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: nodeAuth{&http.Transport{TLSClientConfig: TLSConfig, Proxy: http.ProxyFromEnvironment}},
+	}
+}
+
+// nodeAuth logs every request in as the node user, redirects to the
+// leader included
+type nodeAuth struct {
+	http.RoundTripper
+}
+
+func (t nodeAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	if NodePassword != "" {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(auth.NodeUser, NodePassword)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Register announces a node to the cluster managers, retrying until the
+// leader accepts it. The other managers redirect to the leader
+func Register(managers []string, nodeID string) {
+	hc := httpClient(10 * time.Second)
+	for cur := 0; ; cur = (cur + 1) % len(managers) {
+		resp, err := hc.PostForm(managers[cur]+"/register", url.Values{"node": {nodeID}})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf(" registered as %s", nodeID)
+				return
+			}
+		}
 		time.Sleep(1 * time.Second)
 	}
 }
 
+// Leave asks the cluster managers to fail over a node that is shutting
+// down, trying each of them until one accepts or timeout passes
+func Leave(managers []string, nodeID string, timeout time.Duration) error {
+	hc := httpClient(timeout)
+	deadline := time.Now().Add(timeout)
+	var err error
+	for cur := 0; time.Now().Before(deadline); cur = (cur + 1) % len(managers) {
+		var resp *http.Response
+		resp, err = hc.PostForm(managers[cur]+"/failover", url.Values{"node": {nodeID}})
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf(" left the cluster as %s", nodeID)
+				return nil
+			}
+			err = fmt.Errorf("%s: %s", managers[cur], resp.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// GetMap returns the vbucket map of the default bucket
 func GetMap() string {
-	return nodeMap
+	return GetBucketMap(DefaultBucket)
+}
+
+// GetBucketMap returns the vbucket map of a bucket, "" if there is none
+func GetBucketMap(bucket string) string {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return buckets[bucket].LuxMap
+}
+
+// GetBuckets returns every bucket in the current map
+func GetBuckets() map[string]Bucket {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+
+	bs := make(map[string]Bucket, len(buckets))
+	for name, b := range buckets {
+		bs[name] = b
+	}
+	return bs
+}
+
+// GetUser returns a user of the cluster, nil if there is no such user
+func GetUser(name string) *auth.User {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return users[name]
+}
+
+// AuthRequired reports whether clients must log in, which they must once
+// the cluster has users
+func AuthRequired() bool {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return len(users) > 0
+}
+
+// Changed returns a channel that is closed when a newer map is accepted
+func Changed() <-chan bool {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return mapChanged
+}
+
+// GetRev returns the revision of the current map, 0 if there is none
+func GetRev() uint64 {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return mapRev
+}
+
+func getRevision() (uint64, uint64) {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	return mapTerm, mapRev
+}
+
+// FindShard returns the vbucket a key belongs to
+func FindShard(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % VbucketCount
+}
+
+// VbucketNodes returns the nodes of a vbucket from a map, owner first
+func VbucketNodes(vbmap string, vbid int) []string {
+	vbuckets := strings.Split(vbmap, ",")
+	if vbid >= len(vbuckets) || vbuckets[vbid] == "" {
+		return nil
+	}
+	return strings.Split(vbuckets[vbid], ";")
 }
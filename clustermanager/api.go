@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// REST api used by orchestration tooling. Requests and responses are
+// JSON, their schemas are served under /schemas/
+
+type nodeRequest struct {
+	Node      string `json:"node"`
+	Rebalance bool   `json:"rebalance,omitempty"`
+}
+
+type nodeInfo struct {
+	Node            string `json:"node"`
+	Status          string `json:"status"`
+	Role            string `json:"role"`
+	Retries         int    `json:"retries"`
+	DownSince       string `json:"down_since,omitempty"`
+	ActiveVbuckets  int    `json:"active_vbuckets"`
+	ReplicaVbuckets int    `json:"replica_vbuckets"`
+}
+
+type mapInfo struct {
+	Term    uint64                `json:"term"`
+	Rev     uint64                `json:"rev"`
+	Buckets map[string]*bucketMap `json:"buckets"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+var schemas = map[string]string{
+	"node-request": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "node-request",
+  "description": "Body of POST /nodes/add and POST /nodes/remove",
+  "type": "object",
+  "properties": {
+    "node": {"type": "string", "description": "host:port of the node"},
+    "rebalance": {"type": "boolean", "description": "add only: rebalance the node in once added"}
+  },
+  "required": ["node"]
+}`,
+	"node-list": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "node-list",
+  "description": "Response of GET /nodes/list",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "node": {"type": "string"},
+      "status": {"enum": ["up", "down", "failed"]},
+      "role": {"enum": ["active", "replica", "none"]},
+      "retries": {"type": "integer", "description": "consecutive failed health checks"},
+      "down_since": {"type": "string", "format": "date-time"},
+      "active_vbuckets": {"type": "integer"},
+      "replica_vbuckets": {"type": "integer"}
+    },
+    "required": ["node", "status", "role", "retries", "active_vbuckets", "replica_vbuckets"]
+  }
+}`,
+	"map": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "map",
+  "description": "Response of GET /map",
+  "type": "object",
+  "properties": {
+    "term": {"type": "integer", "description": "election term of the manager that took over the map last"},
+    "rev": {"type": "integer"},
+    "buckets": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "properties": {
+          "quota": {"type": "integer", "description": "bytes each node may use for the bucket, 0 for no limit"},
+          "replicas": {"type": "integer"},
+          "vbuckets": {
+            "type": "array",
+            "description": "nodes of each vbucket, active node first",
+            "items": {"type": "array", "items": {"type": "string"}}
+          }
+        },
+        "required": ["quota", "replicas", "vbuckets"]
+      }
+    }
+  },
+  "required": ["term", "rev", "buckets"]
+}`,
+	"bucket-request": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "bucket-request",
+  "description": "Body of POST /buckets/create and POST /buckets/delete",
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "pattern": "^[A-Za-z0-9_.-]{1,100}$"},
+    "quota": {"type": "integer", "description": "create only: bytes each node may use for the bucket, 0 for no limit"},
+    "replicas": {"type": "integer", "description": "create only: replicas of each vbucket, defaults to -replicas"}
+  },
+  "required": ["name"]
+}`,
+	"bucket-list": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "bucket-list",
+  "description": "Response of GET /buckets/list, POST /buckets/create and POST /buckets/delete",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "name": {"type": "string"},
+      "quota": {"type": "integer"},
+      "replicas": {"type": "integer"},
+      "nodes": {"type": "integer", "description": "nodes holding vbuckets of the bucket"}
+    },
+    "required": ["name", "quota", "replicas", "nodes"]
+  }
+}`,
+	"user-request": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "user-request",
+  "description": "Body of POST /users/set and POST /users/delete",
+  "type": "object",
+  "properties": {
+    "name": {"type": "string", "pattern": "^[A-Za-z0-9_.-]{1,100}$"},
+    "password": {"type": "string", "description": "set only: required for a new user, the old one is kept if missing"},
+    "roles": {
+      "type": "object",
+      "description": "set only: role per bucket, \"*\" for every other bucket. Required for a new user, the old ones are kept if missing",
+      "additionalProperties": {"enum": ["read", "readwrite", "admin"]}
+    }
+  },
+  "required": ["name"]
+}`,
+	"user-list": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "user-list",
+  "description": "Response of GET /users/list, POST /users/set and POST /users/delete",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "name": {"type": "string"},
+      "roles": {"type": "object", "additionalProperties": {"enum": ["read", "readwrite", "admin"]}}
+    },
+    "required": ["name", "roles"]
+  }
+}`,
+	"rebalance": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "rebalance",
+  "description": "Response of GET /rebalance, POST /rebalance and POST /nodes/remove",
+  "type": "object",
+  "properties": {
+    "running": {"type": "boolean"},
+    "total": {"type": "integer", "description": "vbuckets to move"},
+    "done": {"type": "integer", "description": "vbuckets moved"},
+    "current": {"type": "integer", "description": "vbucket being moved, -1 if none"},
+    "bucket": {"type": "string", "description": "bucket of the vbucket being moved"},
+    "eject": {"type": "array", "items": {"type": "string"}},
+    "error": {"type": "string"}
+  },
+  "required": ["running", "total", "done", "current"]
+}`,
+	"health": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "health",
+  "description": "Response of GET /health",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "properties": {
+      "node": {"type": "string"},
+      "status": {"enum": ["up", "down", "failed"]},
+      "healthy": {"type": "boolean"},
+      "latency_ms": {"type": "number", "description": "round trip of the last NOOP"},
+      "consecutive_failures": {"type": "integer"},
+      "last_check": {"type": "string", "format": "date-time"},
+      "last_error": {"type": "string"},
+      "down_since": {"type": "string", "format": "date-time"}
+    },
+    "required": ["node", "status", "healthy", "latency_ms", "consecutive_failures"]
+  }
+}`,
+	"error": `{
+  "$schema": "http://json-schema.org/draft-04/schema#",
+  "title": "error",
+  "description": "Body of every non 2xx response of the api",
+  "type": "object",
+  "properties": {"error": {"type": "string"}},
+  "required": ["error"]
+}`,
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+func readNodeRequest(w http.ResponseWriter, req *http.Request) (nodeRequest, bool) {
+	var nr nodeRequest
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "must be a POST")
+		return nr, false
+	}
+	if err := json.NewDecoder(req.Body).Decode(&nr); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request body: "+err.Error())
+		return nr, false
+	}
+	if nr.Node == "" || !strings.Contains(nr.Node, ":") {
+		writeError(w, http.StatusBadRequest, "node must be host:port")
+		return nr, false
+	}
+	return nr, true
+}
+
+// AddNode adds a node to the cluster, rebalancing it in if asked to
+func AddNode(w http.ResponseWriter, req *http.Request) {
+	nr, ok := readNodeRequest(w, req)
+	if !ok {
+		return
+	}
+
+	cluster.update(func(tx *stateTx) {
+		if status, ok := tx.node(nr.Node); !ok || status.status == "failed" {
+			tx.setNode(nr.Node, NodeStatus{status: "up", retries: 0})
+		}
+	})
+
+	if nr.Rebalance {
+		if err := startRebalance(nil); err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, listNodes())
+}
+
+// RemoveNode gracefully removes a node by rebalancing it out
+func RemoveNode(w http.ResponseWriter, req *http.Request) {
+	nr, ok := readNodeRequest(w, req)
+	if !ok {
+		return
+	}
+
+	if _, known := cluster.node(nr.Node); !known {
+		writeError(w, http.StatusNotFound, "unknown node "+nr.Node)
+		return
+	}
+
+	if err := startRebalance([]string{nr.Node}); err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	progressLock.Lock()
+	p := progress
+	progressLock.Unlock()
+	writeJSON(w, http.StatusAccepted, p)
+}
+
+// ListNodes lists the nodes with their health and role
+func ListNodes(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, listNodes())
+}
+
+func listNodes() []nodeInfo {
+	nodes := cluster.nodeStatuses()
+	m := cluster.snapshot()
+
+	list := make([]nodeInfo, 0, len(nodes))
+	for node, status := range nodes {
+		info := nodeInfo{
+			Node:    node,
+			Status:  status.status,
+			Role:    "none",
+			Retries: status.retries,
+		}
+		if !status.downSince.IsZero() {
+			info.DownSince = status.downSince.Format(time.RFC3339)
+		}
+		for _, b := range m.Buckets {
+			for _, vbnodes := range b.VBuckets {
+				for i, n := range vbnodes {
+					if n != node {
+						continue
+					}
+					if i == 0 {
+						info.ActiveVbuckets++
+					} else {
+						info.ReplicaVbuckets++
+					}
+				}
+			}
+		}
+		if info.ActiveVbuckets > 0 {
+			info.Role = "active"
+		} else if info.ReplicaVbuckets > 0 {
+			info.Role = "replica"
+		}
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	return list
+}
+
+// Map returns the current vbucket map
+func Map(w http.ResponseWriter, req *http.Request) {
+	m := cluster.snapshot()
+	writeJSON(w, http.StatusOK, mapInfo{Term: m.Term, Rev: m.Rev, Buckets: m.Buckets})
+}
+
+// Schemas serves the JSON schema of the api documents
+func Schemas(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, "/schemas/")
+	if name == "" {
+		var names []string
+		for n := range schemas {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, names)
+		return
+	}
+
+	schema, ok := schemas[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no schema "+name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write([]byte(schema))
+}
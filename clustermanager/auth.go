@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// Requests that change the cluster log in with basic auth, as a user with
+// the admin role on every bucket or as the node user with -nodePassword.
+// The election only takes the node user, the other managers. The keys of
+// the users are only served to the nodes. A manager without a node
+// password and without users is open, like the nodes.
+
+// isNode reports whether the request logged in as the node user
+func isNode(req *http.Request) bool {
+	name, password, ok := req.BasicAuth()
+	return ok && nodePassword != "" && name == auth.NodeUser &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(nodePassword)) == 1
+}
+
+// isAdmin reports whether the request logged in as the node user or as an
+// admin of every bucket
+func isAdmin(req *http.Request) bool {
+	if isNode(req) {
+		return true
+	}
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	u := cluster.snapshot().Users[name]
+	return u != nil && u.Allowed(auth.AllBuckets, auth.Admin) && logins.CheckPassword(name, u, password)
+}
+
+// passwords that checked out, every request logs in again
+var logins auth.Logins
+
+func authRequired() bool {
+	return nodePassword != "" || len(cluster.snapshot().Users) > 0
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="luxstor"`)
+	writeError(w, http.StatusUnauthorized, "authentication required")
+}
+
+// adminOnly turns away requests that didn't log in as an admin, once the
+// cluster has a node password or users
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if authRequired() && !isAdmin(req) {
+			unauthorized(w)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// nodeOnly turns away requests that didn't log in as the node user, always
+// without a node password
+func nodeOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isNode(req) {
+			unauthorized(w)
+			return
+		}
+		h(w, req)
+	}
+}
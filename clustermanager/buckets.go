@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+type bucketRequest struct {
+	Name     string `json:"name"`
+	Quota    uint64 `json:"quota,omitempty"`
+	Replicas *int   `json:"replicas,omitempty"`
+}
+
+type bucketInfo struct {
+	Name     string `json:"name"`
+	Quota    uint64 `json:"quota"`
+	Replicas int    `json:"replicas"`
+	Nodes    int    `json:"nodes"`
+}
+
+var validBucketName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,100}$`)
+
+func readBucketRequest(w http.ResponseWriter, req *http.Request) (bucketRequest, bool) {
+	var br bucketRequest
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "must be a POST")
+		return br, false
+	}
+	if err := json.NewDecoder(req.Body).Decode(&br); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request body: "+err.Error())
+		return br, false
+	}
+	if !validBucketName.MatchString(br.Name) {
+		writeError(w, http.StatusBadRequest, "bucket name must be 1 to 100 letters, digits, '_', '.' or '-'")
+		return br, false
+	}
+	return br, true
+}
+
+// buckets can't be created or deleted while vbuckets are moving, the
+// rebalance works on the buckets that existed when it started
+func rebalanceRunning(w http.ResponseWriter) bool {
+	progressLock.Lock()
+	running := progress.Running
+	progressLock.Unlock()
+
+	if running {
+		writeError(w, http.StatusConflict, "rebalance running")
+	}
+	return running
+}
+
+// CreateBucket adds a bucket laid out over the nodes holding vbuckets, or
+// over every healthy node if there are none
+func CreateBucket(w http.ResponseWriter, req *http.Request) {
+	br, ok := readBucketRequest(w, req)
+	if !ok || rebalanceRunning(w) {
+		return
+	}
+
+	r := replicas
+	if br.Replicas != nil {
+		r = *br.Replicas
+	}
+	if r < 0 {
+		writeError(w, http.StatusBadRequest, "replicas can't be negative")
+		return
+	}
+
+	exists := false
+	cluster.update(func(tx *stateTx) {
+		m := tx.currentMap()
+		if _, exists = m.Buckets[br.Name]; exists {
+			return
+		}
+
+		servers := m.servers()
+		if len(servers) == 0 {
+			for node, status := range tx.nodes() {
+				if status.status == "up" {
+					servers = append(servers, node)
+				}
+			}
+		}
+		sort.Strings(servers)
+
+		next := m.clone()
+		next.Rev++
+		next.Buckets[br.Name] = newBucketMap(servers, br.Quota, r)
+		tx.publish(next)
+	})
+	if exists {
+		writeError(w, http.StatusConflict, "bucket "+br.Name+" exists")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listBuckets())
+}
+
+// DeleteBucket removes a bucket, the nodes drop its data once they see
+// the new map
+func DeleteBucket(w http.ResponseWriter, req *http.Request) {
+	br, ok := readBucketRequest(w, req)
+	if !ok || rebalanceRunning(w) {
+		return
+	}
+
+	exists := false
+	cluster.update(func(tx *stateTx) {
+		m := tx.currentMap()
+		if _, exists = m.Buckets[br.Name]; !exists {
+			return
+		}
+
+		next := m.clone()
+		next.Rev++
+		delete(next.Buckets, br.Name)
+		tx.publish(next)
+	})
+	if !exists {
+		writeError(w, http.StatusNotFound, "no bucket "+br.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listBuckets())
+}
+
+// ListBuckets lists the buckets with their settings
+func ListBuckets(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, listBuckets())
+}
+
+func listBuckets() []bucketInfo {
+	m := cluster.snapshot()
+	list := make([]bucketInfo, 0, len(m.Buckets))
+	for _, name := range m.bucketNames() {
+		b := m.Buckets[name]
+		nodes := make(map[string]bool)
+		for _, vbnodes := range b.VBuckets {
+			for _, n := range vbnodes {
+				nodes[n] = true
+			}
+		}
+		list = append(list, bucketInfo{Name: name, Quota: b.Quota, Replicas: b.Replicas, Nodes: len(nodes)})
+	}
+	return list
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// State shared by the http handlers, the health checks, rebalance and the
+// election. Changes are made through update, holding the state lock. The
+// map is kept as a snapshot that is never modified afterwards, so readers
+// load it without taking the lock and a change stores a new snapshot
+// instead. The nodes are only served a map once a majority of the
+// managers have it, the published one.
+type managerState struct {
+	lock  sync.Mutex
+	nodes map[string]NodeStatus
+	snap  atomic.Value // *mapSnapshot
+	pub   atomic.Value // *mapSnapshot
+}
+
+// a map with its json for the nodes
+type mapSnapshot struct {
+	*clusterMap
+	nodesJSON   []byte    // map of the default bucket served by /nodes
+	bucketsJSON []byte    // every bucket served by /nodes
+	usersJSON   []byte    // users with their roles and keys, for the nodes
+	rolesJSON   []byte    // users with their roles only, for anyone else
+	changed     chan bool // closed when a newer snapshot is published
+}
+
+// a bucket as the nodes see it
+type nodesBucket struct {
+	LuxMap   string `json:"luxmap"`
+	Quota    uint64 `json:"quota"`
+	Replicas int    `json:"replicas"`
+}
+
+var cluster = newManagerState()
+
+func newManagerState() *managerState {
+	s := &managerState{nodes: make(map[string]NodeStatus)}
+	snap := newSnapshot(&clusterMap{Buckets: make(map[string]*bucketMap)})
+	s.snap.Store(snap)
+	s.pub.Store(snap)
+	return s
+}
+
+func newSnapshot(m *clusterMap) *mapSnapshot {
+	defaultMap := ""
+	buckets := make(map[string]nodesBucket, len(m.Buckets))
+	for name, b := range m.Buckets {
+		buckets[name] = nodesBucket{LuxMap: b.String(), Quota: b.Quota, Replicas: b.Replicas}
+		if name == defaultBucket {
+			defaultMap = b.String()
+		}
+	}
+
+	nodesJSON, _ := json.Marshal(map[string]string{
+		"serverList": strings.Join(m.servers(), ","),
+		"luxmap":     defaultMap,
+	})
+	bucketsJSON, _ := json.Marshal(buckets)
+	usersJSON, _ := json.Marshal(m.Users)
+	roles := make(map[string]*auth.User, len(m.Users))
+	for name, u := range m.Users {
+		roles[name] = &auth.User{Roles: u.Roles}
+	}
+	rolesJSON, _ := json.Marshal(roles)
+	return &mapSnapshot{
+		clusterMap:  m,
+		nodesJSON:   nodesJSON,
+		bucketsJSON: bucketsJSON,
+		usersJSON:   usersJSON,
+		rolesJSON:   rolesJSON,
+		changed:     make(chan bool),
+	}
+}
+
+// snapshot returns the current map
+func (s *managerState) snapshot() *mapSnapshot {
+	return s.snap.Load().(*mapSnapshot)
+}
+
+// published returns the map served to the nodes
+func (s *managerState) published() *mapSnapshot {
+	return s.pub.Load().(*mapSnapshot)
+}
+
+// publish serves snap to the nodes unless a newer map is served already,
+// the leader calls it once a majority of the managers have snap
+func (s *managerState) publish(snap *mapSnapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.publishLocked(snap)
+}
+
+// publishUpTo publishes the current map unless it is newer than term and
+// rev, the map the leader published
+func (s *managerState) publishUpTo(term, rev uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if snap := s.snapshot(); !newer(snap.Term, snap.Rev, term, rev) {
+		s.publishLocked(snap)
+	}
+}
+
+func (s *managerState) publishLocked(snap *mapSnapshot) {
+	old := s.published()
+	if !newer(snap.Term, snap.Rev, old.Term, old.Rev) {
+		return
+	}
+	s.pub.Store(snap)
+	close(old.changed)
+	log.Printf("published map rev %d: %s", snap.Rev, snap.String())
+	// tell the followers at once
+	kickHeartbeat()
+}
+
+// node returns the status of a node
+func (s *managerState) node(name string) (NodeStatus, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status, ok := s.nodes[name]
+	return status, ok
+}
+
+// nodeStatuses returns a copy of the status of every node
+func (s *managerState) nodeStatuses() map[string]NodeStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	nodes := make(map[string]NodeStatus, len(s.nodes))
+	for node, status := range s.nodes {
+		nodes[node] = status
+	}
+	return nodes
+}
+
+// state returns the cluster state as it is saved and replicated
+func (s *managerState) state() savedState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stateLocked()
+}
+
+// stateAndMap is state with the snapshot of the map in it
+func (s *managerState) stateAndMap() (savedState, *mapSnapshot) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stateLocked(), s.snapshot()
+}
+
+func (s *managerState) stateLocked() savedState {
+	m := s.snapshot()
+	st := savedState{
+		Term:    m.Term,
+		Rev:     m.Rev,
+		Buckets: m.Buckets,
+		Users:   m.Users,
+		Nodes:   make(map[string]string, len(s.nodes)),
+	}
+	for node, status := range s.nodes {
+		st.Nodes[node] = status.status
+	}
+	return st
+}
+
+// update runs fn with the state locked. A map given to tx.publish becomes
+// the current map once fn returns, and the state is saved and replicated
+// if the map or the status of a node changed. The map is published when
+// a majority of the managers have acked it, at once without other
+// managers
+func (s *managerState) update(fn func(tx *stateTx)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx := &stateTx{s: s}
+	fn(tx)
+
+	if tx.next != nil {
+		snap := newSnapshot(tx.next)
+		s.snap.Store(snap)
+		if len(peers) == 0 {
+			s.publishLocked(snap)
+		}
+	}
+	if tx.next != nil || tx.dirty {
+		saveState(s.stateLocked())
+		kickHeartbeat()
+	}
+}
+
+// changes made within update
+type stateTx struct {
+	s     *managerState
+	next  *clusterMap
+	dirty bool
+}
+
+// currentMap returns the map as of this change. It must not be modified,
+// changes are made to a clone and published
+func (tx *stateTx) currentMap() *clusterMap {
+	if tx.next != nil {
+		return tx.next
+	}
+	return tx.s.snapshot().clusterMap
+}
+
+func (tx *stateTx) publish(m *clusterMap) {
+	tx.next = m
+}
+
+// nodes returns the nodes for reading, use setNode and deleteNode to
+// change them
+func (tx *stateTx) nodes() map[string]NodeStatus {
+	return tx.s.nodes
+}
+
+func (tx *stateTx) node(name string) (NodeStatus, bool) {
+	status, ok := tx.s.nodes[name]
+	return status, ok
+}
+
+func (tx *stateTx) setNode(name string, status NodeStatus) {
+	if old, ok := tx.s.nodes[name]; !ok || old.status != status.status {
+		tx.dirty = true
+	}
+	tx.s.nodes[name] = status
+}
+
+func (tx *stateTx) deleteNode(name string) {
+	if _, ok := tx.s.nodes[name]; ok {
+		delete(tx.s.nodes, name)
+		tx.dirty = true
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
+)
+
+// The leader probes every node with a NOOP over the memcached protocol.
+// Each node keeps one probe connection, dropped when a probe fails
+
+var (
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+)
+
+type probeResult struct {
+	node    string
+	at      time.Time
+	latency time.Duration
+	err     error
+}
+
+type nodeHealth struct {
+	Node                string  `json:"node"`
+	Status              string  `json:"status"`
+	Healthy             bool    `json:"healthy"`
+	LatencyMs           float64 `json:"latency_ms"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	LastCheck           string  `json:"last_check,omitempty"`
+	LastError           string  `json:"last_error,omitempty"`
+	DownSince           string  `json:"down_since,omitempty"`
+}
+
+var (
+	probes     = make(map[string]*memcached.Client)
+	probesLock sync.Mutex
+)
+
+func watchNodes() {
+	for {
+		time.Sleep(healthInterval)
+
+		// only the leader watches the nodes
+		if !isLeader() {
+			closeProbes()
+			continue
+		}
+		checkNodes()
+	}
+}
+
+// probe all nodes that haven't been failed over at once, then update
+// their status
+func checkNodes() {
+	var targets []string
+	for node, status := range cluster.nodeStatuses() {
+		if status.status != "failed" {
+			targets = append(targets, node)
+		}
+	}
+
+	results := make([]probeResult, len(targets))
+	var wg sync.WaitGroup
+	for i, node := range targets {
+		wg.Add(1)
+		go func(i int, node string) {
+			defer wg.Done()
+			results[i] = probe(node)
+		}(i, node)
+	}
+	wg.Wait()
+
+	cluster.update(func(tx *stateTx) {
+		for _, r := range results {
+			updateHealth(tx, r)
+		}
+	})
+}
+
+func updateHealth(tx *stateTx, r probeResult) {
+	status, ok := tx.node(r.node)
+	if !ok || status.status == "failed" {
+		// removed or failed over while being probed
+		return
+	}
+
+	status.lastCheck = r.at
+	status.latency = r.latency
+	if r.err == nil {
+		if status.status != "up" {
+			log.Printf("node %s is up", r.node)
+		}
+		status.status = "up"
+		status.retries = 0
+		status.downSince = time.Time{}
+		status.lastError = ""
+		tx.setNode(r.node, status)
+		return
+	}
+
+	if status.status != "down" {
+		status.downSince = r.at
+	}
+	status.status = "down"
+	status.retries++
+	status.lastError = r.err.Error()
+	tx.setNode(r.node, status)
+	log.Printf("node %s failed health check %d: %v", r.node, status.retries, r.err)
+
+	if autoFailover > 0 && time.Since(status.downSince) >= autoFailover {
+		failover(tx, r.node)
+	}
+}
+
+func probe(node string) probeResult {
+	start := time.Now()
+	mc, err := probeConn(node)
+	if err == nil {
+		mc.SetDeadline(start.Add(healthTimeout))
+		_, err = mc.Send(&gomemcached.MCRequest{Opcode: gomemcached.NOOP})
+		if err != nil {
+			dropProbe(node)
+		}
+	}
+	return probeResult{node: node, at: start, latency: time.Since(start), err: err}
+}
+
+func probeConn(node string) (*memcached.Client, error) {
+	probesLock.Lock()
+	mc, ok := probes[node]
+	probesLock.Unlock()
+	if ok {
+		return mc, nil
+	}
+
+	mc, err := dialNode(node, healthTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	probesLock.Lock()
+	probes[node] = mc
+	probesLock.Unlock()
+	return mc, nil
+}
+
+func dropProbe(node string) {
+	probesLock.Lock()
+	defer probesLock.Unlock()
+
+	if mc, ok := probes[node]; ok {
+		mc.Close()
+		delete(probes, node)
+	}
+}
+
+func closeProbes() {
+	probesLock.Lock()
+	defer probesLock.Unlock()
+
+	for node, mc := range probes {
+		mc.Close()
+		delete(probes, node)
+	}
+}
+
+// Health reports the result of the last health check of every node
+func Health(w http.ResponseWriter, req *http.Request) {
+	nodes := cluster.nodeStatuses()
+	list := make([]nodeHealth, 0, len(nodes))
+	for node, status := range nodes {
+		h := nodeHealth{
+			Node:                node,
+			Status:              status.status,
+			Healthy:             status.status == "up",
+			LatencyMs:           float64(status.latency) / float64(time.Millisecond),
+			ConsecutiveFailures: status.retries,
+			LastError:           status.lastError,
+		}
+		if !status.lastCheck.IsZero() {
+			h.LastCheck = status.lastCheck.Format(time.RFC3339Nano)
+		}
+		if !status.downSince.IsZero() {
+			h.DownSince = status.downSince.Format(time.RFC3339)
+		}
+		list = append(list, h)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+	writeJSON(w, http.StatusOK, list)
+}
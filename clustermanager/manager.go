@@ -1,40 +1,37 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"log"
-	"net"
 	"net/http"
+	"os"
 	"runtime"
 	"sort"
 	"strings"
 	"time"
-
-	"github.com/couchbaselabs/clog"
 )
 
 const vbucketCount = 2
 
 type NodeStatus struct {
-	status  string
-	retries int
-}
-
-type vbucketMap struct {
-	id    int
-	nodes []string
+	status    string
+	retries   int // consecutive failed health checks
+	downSince time.Time
+	lastCheck time.Time
+	latency   time.Duration
+	lastError string
 }
 
 var (
-	address   string
-	port      int
-	logPath   string
-	hosts     string
-	nodes     = make(map[string]NodeStatus)
-	bucketMap = make(map[string]string)
+	address      string
+	port         int
+	logPath      string
+	hosts        string
+	replicas     int
+	autoFailover time.Duration
+	peerList     string
+	nodePassword string
 )
 
 func init() {
@@ -43,134 +40,200 @@ func init() {
 
 	flag.StringVar(&address, "address", "", "Address to listen on, Default is to all")
 	flag.IntVar(&port, "port", 8091, "Port to listen on. Default is 8091")
-	flag.StringVar(&logPath, "path", "manager", "cluster manager logging dir")
+	flag.StringVar(&logPath, "path", "manager", "cluster manager state dir")
 	flag.StringVar(&hosts, "host", "localhost:11212", "nodes to manage")
-	flag.Parse()
+	flag.IntVar(&replicas, "replicas", 1, "Number of replicas of each vbucket")
+	flag.DurationVar(&autoFailover, "autoFailover", 30*time.Second, "Fail over a node after it has been down this long, 0 disables")
+	flag.DurationVar(&healthInterval, "healthInterval", time.Second, "Time between health checks of the nodes")
+	flag.DurationVar(&healthTimeout, "healthTimeout", 2*time.Second, "Time a node has to answer a health check")
+	flag.StringVar(&selfURL, "self", "", "Url the other cluster managers reach this one at. Default is http(s)://localhost:port")
+	flag.StringVar(&peerList, "peers", "", "Urls of the other cluster managers, comma separated")
+	flag.StringVar(&nodePassword, "nodePassword", "", "Password the nodes and managers of the cluster log in to each other with")
+	flag.StringVar(&tlsCert, "tlsCert", "", "Certificate (PEM) of this manager, serves the api over https")
+	flag.StringVar(&tlsKey, "tlsKey", "", "Key (PEM) of the -tlsCert certificate")
+	flag.StringVar(&tlsCA, "tlsCA", "", "CA (PEM) the certificates of the cluster are signed by")
+	flag.BoolVar(&tlsNodes, "tlsNodes", false, "Connect to the nodes with mutual TLS")
 
 }
 
-func hash(s string) uint32 {
-	h := fnv.New32a()
-	h.Write([]byte(s))
-	return h.Sum32()
-}
-
+// Nodes returns the published map. With rev set the request is held, for
+// up to wait, until a revision newer than term and rev is published. Only
+// the nodes get the keys of the users, anyone else just their roles, so
+// a node that can't log in still knows the cluster has users
 func Nodes(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(200)
+	var term, since uint64
+	var wait time.Duration
+	fmt.Sscan(req.FormValue("term"), &term)
+	fmt.Sscan(req.FormValue("rev"), &since)
+	if d, err := time.ParseDuration(req.FormValue("wait")); err == nil {
+		wait = d
+	}
 
-	//onlineNodes := make([]string, 0)
-	//onlineNodes := make(map[string]string)
-	//for node, _ := range bucketMap {
-	//	onlineNodes = append(onlineNodes, node)
-	//}
+	snap := cluster.published()
+	if !newer(snap.Term, snap.Rev, term, since) && wait > 0 {
+		select {
+		case <-snap.changed:
+		case <-time.After(wait):
+		}
+		snap = cluster.published()
+	}
 
-	//oNodes, _ := json.Marshal(onlineNodes)
-	oNodes, _ := json.Marshal(bucketMap)
+	users := snap.rolesJSON
+	if isNode(req) {
+		users = snap.usersJSON
+	}
 
-	fmt.Fprintf(w, fmt.Sprintf("{\"nodes\":%s}", oNodes))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "{\"nodes\":%s,\"buckets\":%s,\"users\":%s,\"term\":%d,\"rev\":%d}",
+		snap.nodesJSON, snap.bucketsJSON, users, snap.Term, snap.Rev)
 }
 
-func main() {
+// Register adds a node, identified by host:port, to the managed nodes.
+// It only gets vbuckets when the cluster is rebalanced
+func Register(w http.ResponseWriter, req *http.Request) {
+	node := req.FormValue("node")
+	if node == "" {
+		http.Error(w, "missing node", http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("listening on %s:%d\n", address, port)
-	log.Printf("cluster manager Path: %s\n", logPath)
+	cluster.update(func(tx *stateTx) {
+		if _, ok := tx.node(node); !ok {
+			log.Printf("registered node %s", node)
+			tx.setNode(node, NodeStatus{status: "up", retries: 0})
+		}
+	})
 
-	for _, host := range strings.Split(hosts, ",") {
+	w.WriteHeader(200)
+}
+
+// Failover fails over the node given in the request, promoting its
+// replicas. Once failed over a node gets no vbuckets until it is added
+// back by a rebalance
+func Failover(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "failover must be a POST", http.StatusMethodNotAllowed)
+		return
+	}
 
-		//conn, err := net.Dial("tcp", host)
-		_, err := net.Dial("tcp", host)
-		//defer conn.Close()
+	node := req.FormValue("node")
 
-		nodes[host] = NodeStatus{status: "up", retries: 0}
-		if err != nil {
-			clog.Error(err)
-			nodes[host] = NodeStatus{status: "down", retries: 0}
-			break
+	known := false
+	cluster.update(func(tx *stateTx) {
+		if _, known = tx.node(node); known {
+			failover(tx, node)
 		}
+	})
+	if !known {
+		http.Error(w, "unknown node "+node, http.StatusNotFound)
+		return
 	}
 
-	nodeCount := len(nodes)
+	fmt.Fprintf(w, "{\"rev\":%d}", cluster.snapshot().Rev)
+}
 
-	servers := make([]string, 0, nodeCount)
-	for n := range nodes {
-		servers = append(servers, n)
+func failover(tx *stateTx, node string) {
+	log.Printf("failing over node %s", node)
+	status, _ := tx.node(node)
+	status.status = "failed"
+	tx.setNode(node, status)
+
+	m := tx.currentMap()
+	for _, n := range m.servers() {
+		if n == node {
+			tx.publish(m.failover(node))
+			return
+		}
 	}
-	sort.Strings(servers)
-
-	fmt.Printf("%#v\n", nodes)
+}
 
-	vbmap := make(map[int][]string)
+func main() {
+	flag.Parse()
 
-	//TODO - fix it
-	for i := 0; i < nodeCount; i++ {
-		if hash(servers[i])%2 == 0 {
-			vbmap[0] = append(vbmap[0], servers[i])
-		} else {
-			vbmap[1] = append(vbmap[1], servers[i])
+	serverTLS := setupTLS()
+	if selfURL == "" {
+		scheme := "http"
+		if serverTLS != nil {
+			scheme = "https"
 		}
+		selfURL = fmt.Sprintf("%s://localhost:%d", scheme, port)
+	}
+	selfURL = strings.TrimRight(selfURL, "/")
+	peers = parsePeers(peerList)
+	if len(peers) > 0 && nodePassword == "" {
+		log.Fatalf("-peers needs -nodePassword, the managers log in to each other with it")
 	}
 
-	bucketMap["serverList"] = hosts
-	bucketMap["luxmap"] = strings.Join(vbmap[0], ";") + "," + strings.Join(vbmap[1], ";")
-	//bucketMap["luxmap"] = "0:" + strings.Join(vbmap[0], ";") + ", 1:" + strings.Join(vbmap[1], ";")
-
-	fmt.Println("vbmap:", bucketMap)
-
-	//Polling nodes, needs cleanup
-	go func() {
-		for {
-			for node, _ := range nodes {
-				_, err := net.Dial("tcp", node)
-				//conn, err := net.Dial("tcp", node)
-				//defer conn.Close()
-
-				if err != nil {
-					clog.Error(err)
-					fmt.Println("retry count:", nodes[node].retries, " node:", node)
-					retryCount := nodes[node].retries + 1
-
-					if retryCount <= 3 {
-						nodes[node] = NodeStatus{status: "down", retries: retryCount}
-					} else {
-						delete(nodes, node)
-					}
-					break
-				} else {
-					nodes[node] = NodeStatus{status: "up", retries: 0}
-				}
-			}
-
-			nodeCount := len(nodes)
-			servers := make([]string, 0, nodeCount)
-			for n := range nodes {
-				servers = append(servers, n)
-			}
-			sort.Strings(servers)
-			fmt.Printf("%#v\n", nodes)
+	log.Printf("listening on %s:%d\n", address, port)
+	log.Printf("cluster manager Path: %s\n", logPath)
 
-			vbmap = make(map[int][]string)
+	if err := os.MkdirAll(logPath, 0755); err != nil {
+		log.Fatalf("Cannot create state dir: %v", err)
+	}
+	st, err := loadState()
+	if err != nil {
+		log.Fatalf("Cannot load cluster state: %v", err)
+	}
+	if err := loadRaft(); err != nil {
+		log.Fatalf("Cannot load election state: %v", err)
+	}
 
-			//TODO - fix it
-			for i := 0; i < nodeCount; i++ {
-				if hash(servers[i])%2 == 0 {
-					vbmap[0] = append(vbmap[0], servers[i])
-				} else {
-					vbmap[1] = append(vbmap[1], servers[i])
+	servers := strings.Split(hosts, ",")
+	sort.Strings(servers)
+	cluster.update(func(tx *stateTx) {
+		if st != nil {
+			// the saved cluster wins, hosts not part of it are added
+			// as nodes without vbuckets
+			log.Printf("loaded cluster state rev %d", st.Rev)
+			for node, status := range st.Nodes {
+				if status != "failed" {
+					status = "up"
 				}
+				tx.setNode(node, NodeStatus{status: status, retries: 0})
 			}
+			tx.publish(&clusterMap{Term: st.Term, Rev: st.Rev, Buckets: st.Buckets, Users: st.Users})
+		} else {
+			tx.publish(newClusterMap(servers, replicas))
+		}
 
-			bucketMap["serverList"] = strings.Join(servers, ",")
-			bucketMap["luxmap"] = strings.Join(vbmap[0], ";") + "," + strings.Join(vbmap[1], ";")
-			//bucketMap["luxmap"] = "0:" + strings.Join(vbmap[0], ";") + ", 1:" + strings.Join(vbmap[1], ";")
-			fmt.Printf("%#v\n", nodes)
-			time.Sleep(time.Second)
+		for _, host := range servers {
+			if _, ok := tx.node(host); !ok {
+				tx.setNode(host, NodeStatus{status: "up", retries: 0})
+			}
 		}
-	}()
+	})
+	log.Printf("managing %d nodes", len(cluster.nodeStatuses()))
 
-	http.HandleFunc("/nodes", Nodes)
+	go runRaft()
+	go watchNodes()
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", address, port), nil)
+	http.HandleFunc("/nodes", Nodes)
+	http.HandleFunc("/register", leaderOnly(adminOnly(Register)))
+	http.HandleFunc("/failover", leaderOnly(adminOnly(Failover)))
+	http.HandleFunc("/rebalance", leaderOnly(adminOnly(Rebalance)))
+	http.HandleFunc("/nodes/add", leaderOnly(adminOnly(AddNode)))
+	http.HandleFunc("/nodes/remove", leaderOnly(adminOnly(RemoveNode)))
+	http.HandleFunc("/nodes/list", ListNodes)
+	http.HandleFunc("/buckets/create", leaderOnly(adminOnly(CreateBucket)))
+	http.HandleFunc("/buckets/delete", leaderOnly(adminOnly(DeleteBucket)))
+	http.HandleFunc("/buckets/list", ListBuckets)
+	http.HandleFunc("/users/set", leaderOnly(adminOnly(SetUser)))
+	http.HandleFunc("/users/delete", leaderOnly(adminOnly(DeleteUser)))
+	http.HandleFunc("/users/list", ListUsers)
+	http.HandleFunc("/map", Map)
+	http.HandleFunc("/schemas/", Schemas)
+	http.HandleFunc("/health", leaderOnly(Health))
+	http.HandleFunc("/raft/vote", nodeOnly(RaftVote))
+	http.HandleFunc("/raft/append", nodeOnly(RaftAppend))
+	http.HandleFunc("/raft/status", RaftStatus)
+
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%d", address, port), TLSConfig: serverTLS}
+	if serverTLS != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatalf("Failed to start cluster manager: %v", err)
 	}
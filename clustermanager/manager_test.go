@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+type nodesResponse struct {
+	Nodes   map[string]string      `json:"nodes"`
+	Buckets map[string]nodesBucket `json:"buckets"`
+	Users   map[string]*auth.User  `json:"users"`
+	Term    uint64                 `json:"term"`
+	Rev     uint64                 `json:"rev"`
+}
+
+// a fresh cluster of unreachable nodes, saving its state to a temp dir
+func setupCluster(t *testing.T, servers []string) {
+	logPath = t.TempDir()
+	healthTimeout = 100 * time.Millisecond
+	cluster = newManagerState()
+	cluster.update(func(tx *stateTx) {
+		for _, node := range servers {
+			tx.setNode(node, NodeStatus{status: "up"})
+		}
+		tx.publish(newClusterMap(servers, 1))
+	})
+}
+
+// the map as a node sees it, logged in as the node user
+func getNodes(t *testing.T, query string) nodesResponse {
+	req := httptest.NewRequest("GET", "/nodes"+query, nil)
+	req.SetBasicAuth(auth.NodeUser, nodePassword)
+	w := httptest.NewRecorder()
+	Nodes(w, req)
+
+	var resp nodesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad /nodes response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+// health checks failing nodes over while the map is read and nodes are
+// registered and failed over through the api. Run with -race
+func TestConcurrentPollingAndNodes(t *testing.T) {
+	var servers []string
+	for i := 1; i <= 8; i++ {
+		servers = append(servers, fmt.Sprintf("127.0.0.1:%d", i))
+	}
+	setupCluster(t, servers)
+	autoFailover = time.Nanosecond
+	defer func() { autoFailover = 30 * time.Second }()
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			checkNodes()
+		}
+		close(done)
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var rev uint64
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				resp := getNodes(t, "")
+				if resp.Rev < rev {
+					t.Errorf("map went back from rev %d to %d", rev, resp.Rev)
+				}
+				rev = resp.Rev
+
+				listNodes()
+				Health(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+
+				node := fmt.Sprintf("127.0.0.1:%d", 100+i)
+				Register(httptest.NewRecorder(), httptest.NewRequest("POST", "/register?node="+node, nil))
+				Failover(httptest.NewRecorder(), httptest.NewRequest("POST", "/failover?node="+node, nil))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for node, status := range cluster.nodeStatuses() {
+		if status.status != "failed" {
+			t.Errorf("node %s is %s, expected failed", node, status.status)
+		}
+	}
+	if m := cluster.snapshot(); len(m.servers()) != 0 {
+		t.Errorf("failed nodes left in the map: %s", m.String())
+	}
+}
+
+func TestNodesLongPoll(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1", "127.0.0.1:2"})
+	m := cluster.snapshot()
+
+	start := time.Now()
+	published := make(chan bool)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cluster.update(func(tx *stateTx) {
+			failover(tx, "127.0.0.1:1")
+		})
+		close(published)
+	}()
+
+	resp := getNodes(t, fmt.Sprintf("?term=%d&rev=%d&wait=10s", m.Term, m.Rev))
+	if resp.Rev != m.Rev+1 {
+		t.Errorf("expected rev %d, got %d", m.Rev+1, resp.Rev)
+	}
+	if resp.Nodes["luxmap"] != "127.0.0.1:2,127.0.0.1:2" {
+		t.Errorf("unexpected map %q", resp.Nodes["luxmap"])
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("long poll was not woken up by the new map")
+	}
+	<-published
+
+	// nothing newer, the request returns the current map after wait
+	resp = getNodes(t, fmt.Sprintf("?term=%d&rev=%d&wait=50ms", resp.Term, resp.Rev))
+	if resp.Rev != m.Rev+1 {
+		t.Errorf("expected rev %d, got %d", m.Rev+1, resp.Rev)
+	}
+}
+
+// published snapshots are never modified by later changes
+func TestSnapshotCopyOnWrite(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1", "127.0.0.1:2"})
+	old := cluster.snapshot()
+	before := old.String()
+
+	cluster.update(func(tx *stateTx) {
+		failover(tx, "127.0.0.1:1")
+	})
+
+	if old.String() != before {
+		t.Errorf("published map changed from %s to %s", before, old.String())
+	}
+	if strings.Contains(cluster.snapshot().String(), "127.0.0.1:1") {
+		t.Errorf("failed node still in map %s", cluster.snapshot().String())
+	}
+	select {
+	case <-old.changed:
+	default:
+		t.Errorf("old snapshot not marked as changed")
+	}
+}
+
+// the leader of three managers publishes a map once one of the others
+// has acked it
+func TestPublishOnQuorum(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1", "127.0.0.1:2"})
+	acking := false
+	acker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !acking {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"term":1,"success":true}`)
+	}))
+	defer acker.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	peers = []string{acker.URL, down.URL}
+	raft, role, lastQuorum = raftState{Term: 1}, leader, time.Now()
+	defer func() { peers, raft, role = nil, raftState{}, follower }()
+
+	rev := cluster.snapshot().Rev
+	cluster.update(func(tx *stateTx) {
+		failover(tx, "127.0.0.1:1")
+	})
+	sendHeartbeats()
+	if resp := getNodes(t, ""); resp.Rev != rev {
+		t.Errorf("rev %d published without a majority", resp.Rev)
+	}
+
+	acking = true
+	sendHeartbeats()
+	if resp := getNodes(t, ""); resp.Rev != rev+1 {
+		t.Errorf("rev %d published, want %d", resp.Rev, rev+1)
+	}
+}
+
+// a move is not handed over to a node that went down since the
+// rebalance started
+func TestMoveToFailedNode(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1", "127.0.0.1:2"})
+	cluster.update(func(tx *stateTx) {
+		next := tx.currentMap().clone()
+		next.Buckets[defaultBucket].VBuckets[0] = nil
+		tx.publish(next)
+		tx.setNode("127.0.0.1:2", NodeStatus{status: "failed"})
+	})
+
+	if err := moveVbucket(defaultBucket, 0, []string{"127.0.0.1:2"}); err == nil {
+		t.Errorf("vbucket handed over to a failed node")
+	}
+	if nodes := cluster.snapshot().Buckets[defaultBucket].VBuckets[0]; len(nodes) != 0 {
+		t.Errorf("map changed to %v", nodes)
+	}
+
+	if err := moveVbucket(defaultBucket, 0, []string{"127.0.0.1:1"}); err != nil {
+		t.Fatalf("move failed: %v", err)
+	}
+	if nodes := cluster.snapshot().Buckets[defaultBucket].VBuckets[0]; len(nodes) != 1 || nodes[0] != "127.0.0.1:1" {
+		t.Errorf("vbucket not handed over, map has %v", nodes)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1", "127.0.0.1:2"})
+
+	w := httptest.NewRecorder()
+	CreateBucket(w, httptest.NewRequest("POST", "/buckets/create",
+		strings.NewReader(`{"name":"b2","quota":1048576,"replicas":0}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	CreateBucket(w, httptest.NewRequest("POST", "/buckets/create", strings.NewReader(`{"name":"b2"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a conflict creating b2 twice, got %d", w.Code)
+	}
+
+	resp := getNodes(t, "")
+	b2, ok := resp.Buckets["b2"]
+	if !ok || b2.Quota != 1048576 || b2.Replicas != 0 || b2.LuxMap != "127.0.0.1:1,127.0.0.1:2" {
+		t.Errorf("unexpected bucket b2 %+v", b2)
+	}
+	if resp.Buckets[defaultBucket].LuxMap != resp.Nodes["luxmap"] {
+		t.Errorf("luxmap %q is not the default bucket's map", resp.Nodes["luxmap"])
+	}
+
+	// a failover takes the node out of every bucket
+	cluster.update(func(tx *stateTx) {
+		failover(tx, "127.0.0.1:1")
+	})
+	resp = getNodes(t, "")
+	for name, b := range resp.Buckets {
+		if strings.Contains(b.LuxMap, "127.0.0.1:1") {
+			t.Errorf("failed node still in bucket %s: %s", name, b.LuxMap)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	DeleteBucket(w, httptest.NewRequest("POST", "/buckets/delete", strings.NewReader(`{"name":"b2"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := getNodes(t, "").Buckets["b2"]; ok {
+		t.Errorf("bucket b2 still in the map")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1"})
+	auth.Iterations = 16
+	nodePassword = "nodesecret"
+	defer func() { nodePassword = "" }()
+
+	setUser := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		SetUser(w, httptest.NewRequest("POST", "/users/set", strings.NewReader(body)))
+		return w
+	}
+
+	if w := setUser(`{"name":"alice","password":"secret"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("user without roles created: %d", w.Code)
+	}
+	if w := setUser(`{"name":"alice","password":"secret","roles":{"default":"owner"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("user with a bad role created: %d", w.Code)
+	}
+	if w := setUser(`{"name":"@node","password":"secret","roles":{"*":"admin"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("reserved user created: %d", w.Code)
+	}
+	if w := setUser(`{"name":"alice","password":"secret","roles":{"default":"readwrite"}}`); w.Code != http.StatusOK {
+		t.Fatalf("create failed: %d %s", w.Code, w.Body.String())
+	}
+
+	// the nodes get the keys, never the password
+	resp := getNodes(t, "")
+	u := resp.Users["alice"]
+	if u == nil || !u.CheckPassword("secret") || !u.Allowed("default", auth.ReadWrite) {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	if strings.Contains(fmt.Sprint(cluster.state()), "secret") {
+		t.Errorf("password saved in the clear")
+	}
+
+	// changing the roles keeps the password
+	if w := setUser(`{"name":"alice","roles":{"*":"read"}}`); w.Code != http.StatusOK {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+	u = getNodes(t, "").Users["alice"]
+	if !u.CheckPassword("secret") || u.Allowed("default", auth.ReadWrite) || !u.Allowed("other", auth.Read) {
+		t.Errorf("unexpected user after update %+v", u)
+	}
+
+	w := httptest.NewRecorder()
+	DeleteUser(w, httptest.NewRequest("POST", "/users/delete", strings.NewReader(`{"name":"alice"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if len(getNodes(t, "").Users) != 0 {
+		t.Errorf("user alice still in the map")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	setupCluster(t, []string{"127.0.0.1:1"})
+	auth.Iterations = 16
+
+	call := func(h http.HandlerFunc, path, body, user, password string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Code
+	}
+	setUser := adminOnly(SetUser)
+	register := adminOnly(Register)
+	raftAppend := nodeOnly(RaftAppend)
+
+	// without a node password users can't be created and the election is closed
+	if code := call(setUser, "/users/set", `{"name":"root","password":"pw","roles":{"*":"admin"}}`, "", ""); code != http.StatusBadRequest {
+		t.Errorf("user created without a node password: %d", code)
+	}
+	if code := call(raftAppend, "/raft/append", `{"term":99}`, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("append taken without a node password: %d", code)
+	}
+
+	nodePassword = "nodesecret"
+	defer func() { nodePassword = "" }()
+
+	if code := call(setUser, "/users/set", `{"name":"root","password":"pw","roles":{"*":"admin"}}`, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("user created without logging in: %d", code)
+	}
+	if code := call(setUser, "/users/set", `{"name":"root","password":"pw","roles":{"*":"admin"}}`, auth.NodeUser, "nodesecret"); code != http.StatusOK {
+		t.Fatalf("node user cannot create users: %d", code)
+	}
+	if code := call(setUser, "/users/set", `{"name":"bob","password":"pw","roles":{"default":"admin"}}`, "root", "pw"); code != http.StatusOK {
+		t.Fatalf("admin cannot create users: %d", code)
+	}
+	if code := call(setUser, "/users/set", `{"name":"eve","password":"pw","roles":{"*":"admin"}}`, "bob", "pw"); code != http.StatusUnauthorized {
+		t.Errorf("admin of one bucket created a user: %d", code)
+	}
+	if code := call(setUser, "/users/set", `{"name":"eve","password":"pw","roles":{"*":"admin"}}`, "root", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("user created with a wrong password: %d", code)
+	}
+	if code := call(register, "/register?node=127.0.0.1:2", "", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("node registered without logging in: %d", code)
+	}
+	if code := call(register, "/register?node=127.0.0.1:2", "", auth.NodeUser, "nodesecret"); code != http.StatusOK {
+		t.Errorf("node cannot register: %d", code)
+	}
+
+	// only the other managers take part in the election
+	if code := call(raftAppend, "/raft/append", `{"term":99}`, "root", "pw"); code != http.StatusUnauthorized {
+		t.Errorf("append taken from an admin: %d", code)
+	}
+
+	// anyone else only sees the roles of the users
+	w := httptest.NewRecorder()
+	Nodes(w, httptest.NewRequest("GET", "/nodes", nil))
+	var resp nodesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad /nodes response %q: %v", w.Body.String(), err)
+	}
+	if u := resp.Users["root"]; u == nil || u.Role("default") != auth.Admin || u.Salt != nil || u.SHA256.StoredKey != nil || u.SHA512.ServerKey != nil {
+		t.Errorf("keys served without logging in: %+v", u)
+	}
+	if u := getNodes(t, "").Users["root"]; u == nil || !u.CheckPassword("pw") {
+		t.Errorf("keys not served to the nodes: %+v", u)
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// Several cluster managers elect a leader between them, using the
+// election part of raft over http. Only the leader watches the nodes and
+// changes the map. Instead of a log the leader sends its whole cluster
+// state with every heartbeat, the followers save it and serve the map so
+// the nodes can follow it from any manager. A map is only published to
+// the nodes once a majority of the managers have acked it, the followers
+// learn how far the leader got with the next heartbeat. A vote is only
+// given to a candidate whose map is at least as new as the voter's, so a
+// new leader starts from the newest map a majority has seen, and with it
+// every map that was published.
+
+const (
+	follower  = "follower"
+	candidate = "candidate"
+	leader    = "leader"
+)
+
+var (
+	selfURL string
+	peers   []string
+
+	// a follower that hears nothing from a leader for electionTimeout,
+	// plus up to as much again at random, stands for election
+	electionTimeout   = 2 * time.Second
+	heartbeatInterval = 500 * time.Millisecond
+)
+
+// term and vote must survive a restart, or a manager could vote twice in
+// the same term
+type raftState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+const raftFile = "raft.json"
+
+var (
+	raftLock     sync.Mutex
+	raft         raftState
+	role         = follower
+	leaderURL    string
+	lastContact  time.Time // last heartbeat from the leader or vote given
+	lastQuorum   time.Time // last time a majority acked the leader
+	nextElection time.Duration
+	kick         = make(chan bool, 1)
+	raftClient   = &http.Client{Timeout: heartbeatInterval}
+)
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	MapTerm   uint64 `json:"map_term"`
+	MapRev    uint64 `json:"map_rev"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term    uint64     `json:"term"`
+	Leader  string     `json:"leader"`
+	State   savedState `json:"state"`
+	PubTerm uint64     `json:"pub_term"` // the map published by the leader
+	PubRev  uint64     `json:"pub_rev"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+type raftStatus struct {
+	ID     string   `json:"id"`
+	Term   uint64   `json:"term"`
+	Role   string   `json:"role"`
+	Leader string   `json:"leader,omitempty"`
+	Peers  []string `json:"peers"`
+}
+
+func parsePeers(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" && u != selfURL {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func isLeader() bool {
+	raftLock.Lock()
+	defer raftLock.Unlock()
+	return role == leader
+}
+
+// must be called with raftLock held
+func saveRaft() {
+	data, err := json.Marshal(raft)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(logPath, raftFile), data)
+	}
+	if err != nil {
+		log.Printf("failed to save election state: %v", err)
+	}
+}
+
+func loadRaft() error {
+	data, err := ioutil.ReadFile(filepath.Join(logPath, raftFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &raft)
+}
+
+// must be called with raftLock held
+func resetElectionTimer() {
+	lastContact = time.Now()
+	nextElection = electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+// must be called with raftLock held
+func stepDown(term uint64) {
+	if term > raft.Term {
+		raft.Term = term
+		raft.VotedFor = ""
+		saveRaft()
+	}
+	if role == leader {
+		log.Printf("stepping down as leader in term %d", raft.Term)
+	}
+	role = follower
+}
+
+// runRaft sends heartbeats while leader and stands for election when the
+// leader goes quiet
+func runRaft() {
+	raftLock.Lock()
+	resetElectionTimer()
+	raftLock.Unlock()
+
+	// alone there is nobody to wait for
+	if len(peers) == 0 {
+		startElection()
+	}
+
+	for {
+		raftLock.Lock()
+		r := role
+		due := time.Since(lastContact) > nextElection
+		raftLock.Unlock()
+
+		switch {
+		case r == leader:
+			sendHeartbeats()
+			select {
+			case <-kick:
+			case <-time.After(heartbeatInterval):
+			}
+		case due:
+			startElection()
+		default:
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func startElection() {
+	m := cluster.snapshot()
+	mapTerm, mapRev := m.Term, m.Rev
+
+	raftLock.Lock()
+	raft.Term++
+	raft.VotedFor = selfURL
+	saveRaft()
+	role = candidate
+	leaderURL = ""
+	resetElectionTimer()
+	vr := voteRequest{Term: raft.Term, Candidate: selfURL, MapTerm: mapTerm, MapRev: mapRev}
+	raftLock.Unlock()
+
+	log.Printf("starting election for term %d", vr.Term)
+
+	votes := make(chan voteResponse, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			var resp voteResponse
+			if err := raftCall(peer+"/raft/vote", vr, &resp); err != nil {
+				resp = voteResponse{}
+			}
+			votes <- resp
+		}(peer)
+	}
+
+	granted := 1
+	for range peers {
+		resp := <-votes
+		if resp.Granted {
+			granted++
+		}
+		if resp.Term > vr.Term {
+			raftLock.Lock()
+			stepDown(resp.Term)
+			raftLock.Unlock()
+			return
+		}
+	}
+
+	if granted > (len(peers)+1)/2 {
+		becomeLeader(vr.Term)
+	}
+}
+
+func becomeLeader(term uint64) {
+	raftLock.Lock()
+	if role != candidate || raft.Term != term {
+		raftLock.Unlock()
+		return
+	}
+	role = leader
+	leaderURL = selfURL
+	lastQuorum = time.Now()
+	raftLock.Unlock()
+
+	log.Printf("elected leader for term %d", term)
+
+	// take the map over under this term, so the nodes prefer it to
+	// anything an old leader may still publish. Down nodes are given the
+	// full autoFailover time from now
+	cluster.update(func(tx *stateTx) {
+		for node, status := range tx.nodes() {
+			if status.status == "down" {
+				status.downSince = time.Now()
+				tx.setNode(node, status)
+			}
+		}
+		next := tx.currentMap().clone()
+		next.Term = term
+		next.Rev++
+		tx.publish(next)
+	})
+}
+
+// send the cluster state to every follower, and publish its map once a
+// majority has it. A leader that can't reach a majority for an election
+// timeout steps down, as the others may have elected a new one by then
+func sendHeartbeats() {
+	st, snap := cluster.stateAndMap()
+	pub := cluster.published()
+
+	raftLock.Lock()
+	ar := appendRequest{Term: raft.Term, Leader: selfURL, State: st, PubTerm: pub.Term, PubRev: pub.Rev}
+	raftLock.Unlock()
+
+	acks := make(chan appendResponse, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			var resp appendResponse
+			if err := raftCall(peer+"/raft/append", ar, &resp); err != nil {
+				resp = appendResponse{}
+			}
+			acks <- resp
+		}(peer)
+	}
+
+	acked := 1
+	var maxTerm uint64
+	for range peers {
+		resp := <-acks
+		if resp.Success {
+			acked++
+		}
+		if resp.Term > maxTerm {
+			maxTerm = resp.Term
+		}
+	}
+
+	raftLock.Lock()
+	if raft.Term != ar.Term || role != leader {
+		raftLock.Unlock()
+		return
+	}
+	if maxTerm > ar.Term {
+		stepDown(maxTerm)
+		raftLock.Unlock()
+		return
+	}
+	quorum := acked > (len(peers)+1)/2
+	if quorum {
+		lastQuorum = time.Now()
+	} else if time.Since(lastQuorum) > electionTimeout {
+		log.Printf("lost contact with a majority of managers")
+		stepDown(raft.Term)
+		resetElectionTimer()
+	}
+	raftLock.Unlock()
+
+	if quorum {
+		cluster.publish(snap)
+	}
+}
+
+// replicate a change to the followers now instead of on the next
+// heartbeat
+func kickHeartbeat() {
+	select {
+	case kick <- true:
+	default:
+	}
+}
+
+func raftCall(url string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.SetBasicAuth(auth.NodeUser, nodePassword)
+	r, err := raftClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// RaftVote answers a candidate's request for a vote
+func RaftVote(w http.ResponseWriter, req *http.Request) {
+	var vr voteRequest
+	if err := json.NewDecoder(req.Body).Decode(&vr); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	m := cluster.snapshot()
+	mapTerm, mapRev := m.Term, m.Rev
+
+	raftLock.Lock()
+	defer raftLock.Unlock()
+
+	if vr.Term > raft.Term {
+		stepDown(vr.Term)
+	}
+
+	resp := voteResponse{Term: raft.Term}
+	if vr.Term == raft.Term &&
+		(raft.VotedFor == "" || raft.VotedFor == vr.Candidate) &&
+		!newer(mapTerm, mapRev, vr.MapTerm, vr.MapRev) {
+		raft.VotedFor = vr.Candidate
+		saveRaft()
+		resetElectionTimer()
+		resp.Granted = true
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// RaftAppend takes the cluster state from the leader
+func RaftAppend(w http.ResponseWriter, req *http.Request) {
+	var ar appendRequest
+	if err := json.NewDecoder(req.Body).Decode(&ar); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	raftLock.Lock()
+	if ar.Term < raft.Term {
+		resp := appendResponse{Term: raft.Term}
+		raftLock.Unlock()
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	stepDown(ar.Term)
+	if leaderURL != ar.Leader {
+		log.Printf("following leader %s in term %d", ar.Leader, ar.Term)
+	}
+	leaderURL = ar.Leader
+	resetElectionTimer()
+	resp := appendResponse{Term: raft.Term, Success: true}
+	raftLock.Unlock()
+
+	applyState(ar.State)
+	cluster.publishUpTo(ar.PubTerm, ar.PubRev)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// RaftStatus reports this manager's view of the election
+func RaftStatus(w http.ResponseWriter, req *http.Request) {
+	raftLock.Lock()
+	st := raftStatus{ID: selfURL, Term: raft.Term, Role: role, Leader: leaderURL, Peers: peers}
+	raftLock.Unlock()
+
+	writeJSON(w, http.StatusOK, st)
+}
+
+// a follower takes over the leader's node states and map
+func applyState(st savedState) {
+	cluster.update(func(tx *stateTx) {
+		for node, status := range st.Nodes {
+			if old, _ := tx.node(node); old.status != status {
+				tx.setNode(node, NodeStatus{status: status})
+			}
+		}
+		for node := range tx.nodes() {
+			if _, ok := st.Nodes[node]; !ok {
+				tx.deleteNode(node)
+			}
+		}
+
+		m := tx.currentMap()
+		if newer(st.Term, st.Rev, m.Term, m.Rev) {
+			tx.publish(&clusterMap{Term: st.Term, Rev: st.Rev, Buckets: st.Buckets, Users: st.Users})
+		}
+	})
+}
+
+// requests changing the cluster are served by the leader, the other
+// managers redirect them there
+func leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		raftLock.Lock()
+		r, l := role, leaderURL
+		raftLock.Unlock()
+
+		if r == leader {
+			h(w, req)
+			return
+		}
+		if l == "" {
+			writeError(w, http.StatusServiceUnavailable, "no leader elected")
+			return
+		}
+		http.Redirect(w, req, l+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// Time allowed for a node to backfill a vbucket to its new home
+var moveTimeout = 10 * time.Minute
+
+var errLostLeadership = errors.New("no longer the leading cluster manager")
+
+type rebalanceProgress struct {
+	Running bool     `json:"running"`
+	Total   int      `json:"total"`
+	Done    int      `json:"done"`
+	Current int      `json:"current"`
+	Bucket  string   `json:"bucket,omitempty"`
+	Eject   []string `json:"eject,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+var (
+	progress     = rebalanceProgress{Current: -1}
+	progressLock sync.Mutex
+)
+
+// Rebalance starts a rebalance on POST and reports its progress on GET.
+// Nodes listed in eject (comma separated) are moved out of the cluster
+func Rebalance(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		var eject []string
+		if e := req.FormValue("eject"); e != "" {
+			eject = strings.Split(e, ",")
+		}
+		if err := startRebalance(eject); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	progressLock.Lock()
+	p, _ := json.Marshal(progress)
+	progressLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(p)
+}
+
+func startRebalance(eject []string) error {
+	progressLock.Lock()
+	defer progressLock.Unlock()
+
+	if progress.Running {
+		return errors.New("rebalance already running")
+	}
+
+	ejected := make(map[string]bool)
+	for _, node := range eject {
+		ejected[node] = true
+	}
+
+	// the target map spreads the vbuckets over every healthy node that
+	// is not being ejected
+	var servers []string
+	for node, status := range cluster.nodeStatuses() {
+		if status.status == "up" && !ejected[node] {
+			servers = append(servers, node)
+		}
+	}
+
+	if len(servers) == 0 {
+		return errors.New("no nodes to rebalance to")
+	}
+
+	sort.Strings(servers)
+
+	// every bucket is spread over the same servers, keeping its replica
+	// count
+	target := cluster.snapshot().clone()
+	for name, b := range target.Buckets {
+		target.Buckets[name] = newBucketMap(servers, b.Quota, b.Replicas)
+	}
+
+	progress = rebalanceProgress{Running: true, Current: -1, Eject: eject}
+	go rebalance(target, eject)
+	return nil
+}
+
+type vbucketMove struct {
+	bucket string
+	vb     int
+}
+
+// move the vbuckets one at a time. The current active node streams and
+// backfills the vbucket to each node it is new to, then a new map
+// revision hands the vbucket over
+func rebalance(target *clusterMap, eject []string) {
+	var moves []vbucketMove
+
+	m := cluster.snapshot()
+	for _, name := range target.bucketNames() {
+		cur, ok := m.Buckets[name]
+		if !ok {
+			continue
+		}
+		for vb, nodes := range target.Buckets[name].VBuckets {
+			if strings.Join(nodes, ";") != strings.Join(cur.VBuckets[vb], ";") {
+				moves = append(moves, vbucketMove{name, vb})
+			}
+		}
+	}
+
+	progressLock.Lock()
+	progress.Total = len(moves)
+	progressLock.Unlock()
+
+	for _, mv := range moves {
+		progressLock.Lock()
+		progress.Current = mv.vb
+		progress.Bucket = mv.bucket
+		progressLock.Unlock()
+
+		err := errLostLeadership
+		if isLeader() {
+			err = moveVbucket(mv.bucket, mv.vb, target.Buckets[mv.bucket].VBuckets[mv.vb])
+		}
+		if err != nil {
+			log.Printf("rebalance failed moving bucket %s vbucket %d: %v", mv.bucket, mv.vb, err)
+			progressLock.Lock()
+			progress.Running = false
+			progress.Error = err.Error()
+			progressLock.Unlock()
+			return
+		}
+
+		progressLock.Lock()
+		progress.Done++
+		progressLock.Unlock()
+	}
+
+	cluster.update(func(tx *stateTx) {
+		for _, node := range eject {
+			log.Printf("node %s ejected", node)
+			tx.deleteNode(node)
+		}
+	})
+
+	progressLock.Lock()
+	progress.Running = false
+	progress.Current = -1
+	progress.Bucket = ""
+	progressLock.Unlock()
+	log.Printf("rebalance done")
+}
+
+func moveVbucket(bucket string, vb int, to []string) error {
+	b, ok := cluster.snapshot().Buckets[bucket]
+	if !ok {
+		// deleted while rebalancing
+		return nil
+	}
+	from := b.VBuckets[vb]
+
+	var dsts []string
+	for _, node := range to {
+		found := false
+		for _, n := range from {
+			if n == node {
+				found = true
+			}
+		}
+		if !found {
+			dsts = append(dsts, node)
+		}
+	}
+
+	if len(from) == 0 {
+		// nothing left to copy, just hand the vbucket over
+		dsts = nil
+	}
+
+	for i, dst := range dsts {
+		log.Printf("moving bucket %s vbucket %d from %s to %s", bucket, vb, from[0], dst)
+		if err := vbucketCommand(from[0], bucket, fmt.Sprintf("vb-move %d %s", vb, dst)); err != nil {
+			abortMoves(from[0], bucket, vb, dsts[:i+1])
+			return err
+		}
+	}
+
+	// the target was worked out when the rebalance started, a node may
+	// have been failed over or removed since
+	var err error
+	cluster.update(func(tx *stateTx) {
+		next := tx.currentMap().clone()
+		b, ok := next.Buckets[bucket]
+		if !ok {
+			return
+		}
+		if strings.Join(b.VBuckets[vb], ";") != strings.Join(from, ";") {
+			err = fmt.Errorf("vbucket %d of bucket %s changed while moving", vb, bucket)
+			return
+		}
+		for _, node := range to {
+			if status, ok := tx.node(node); !ok || status.status != "up" {
+				err = fmt.Errorf("node %s is no longer up", node)
+				return
+			}
+		}
+		next.Rev++
+		b.VBuckets[vb] = to
+		tx.publish(next)
+	})
+	if err != nil {
+		if len(dsts) > 0 {
+			abortMoves(from[0], bucket, vb, dsts)
+		}
+		return err
+	}
+
+	for _, dst := range dsts {
+		if err := vbucketCommand(from[0], bucket, fmt.Sprintf("vb-move-done %d %s", vb, dst)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stop the source streaming the vbucket to dsts, or it would keep
+// queueing the vbucket's writes to them
+func abortMoves(node string, bucket string, vb int, dsts []string) {
+	for _, dst := range dsts {
+		if err := vbucketCommand(node, bucket, fmt.Sprintf("vb-move-abort %d %s", vb, dst)); err != nil {
+			log.Printf("cannot abort move of bucket %s vbucket %d to %s: %v", bucket, vb, dst, err)
+		}
+	}
+}
+
+// send a vbucket command for a bucket to a node and wait for it to
+// complete
+func vbucketCommand(node string, bucket string, cmd string) error {
+	mc, err := dialNode(node, healthTimeout)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+
+	mc.SetDeadline(time.Now().Add(moveTimeout))
+	if nodePassword != "" {
+		if _, err = mc.AuthPlain(auth.NodeUser, nodePassword); err != nil {
+			return err
+		}
+	}
+	_, err = mc.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SELECT_BUCKET,
+		Key:    []byte(bucket),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = mc.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SET_VBUCKET,
+		Key:    []byte(cmd),
+	})
+	return err
+}
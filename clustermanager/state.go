@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// cluster configuration kept in the manager's directory, so a restarted
+// manager carries on with the same map instead of building a new one
+type savedState struct {
+	Term    uint64                `json:"term"`
+	Rev     uint64                `json:"rev"`
+	Buckets map[string]*bucketMap `json:"buckets"`
+	Users   map[string]*auth.User `json:"users,omitempty"`
+	Nodes   map[string]string     `json:"nodes"`
+
+	// map of the default bucket, saved before there were buckets
+	VBuckets [][]string `json:"vbuckets,omitempty"`
+}
+
+const stateFile = "state.json"
+
+func saveState(st savedState) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(logPath, stateFile), data)
+	}
+	if err != nil {
+		log.Printf("failed to save cluster state: %v", err)
+	}
+}
+
+// returns nil if no state was saved yet
+func loadState() (*savedState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(logPath, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	st := &savedState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.Buckets == nil && st.VBuckets != nil {
+		st.Buckets = map[string]*bucketMap{
+			defaultBucket: {Replicas: replicas, VBuckets: st.VBuckets},
+		}
+		st.VBuckets = nil
+	}
+	return st, nil
+}
+
+// write to a temporary file in the same directory and rename it over
+// path, so a crash leaves either the old or the new file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/gomemcached/client"
+	"github.com/maniktaneja/luxstor/tlsconf"
+)
+
+// With -tlsCert the api is served over https, and with -tlsNodes the
+// nodes are probed and sent vbucket moves over mutual TLS. Other managers
+// given as https urls are checked against -tlsCA
+
+var (
+	tlsCert  string
+	tlsKey   string
+	tlsCA    string
+	tlsNodes bool
+	nodeTLS  *tls.Config // nil for plain connections to the nodes
+)
+
+// setupTLS returns the config of the https listener, nil for plain http
+func setupTLS() *tls.Config {
+	var server *tls.Config
+	if tlsCert != "" {
+		var err error
+		if server, err = tlsconf.Server(tlsCert, tlsKey, tlsCA); err != nil {
+			log.Fatalf("Cannot load TLS certificate: %v", err)
+		}
+	}
+
+	if tlsCA != "" || tlsNodes {
+		cfg, err := tlsconf.Client(tlsCert, tlsKey, tlsCA)
+		if err != nil {
+			log.Fatalf("Cannot load TLS certificate: %v", err)
+		}
+		raftClient.Transport = &http.Transport{TLSClientConfig: cfg}
+		if tlsNodes {
+			nodeTLS = cfg
+		}
+	}
+	return server
+}
+
+// dialNode connects to a node, over TLS with -tlsNodes
+func dialNode(node string, timeout time.Duration) (*memcached.Client, error) {
+	d := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if nodeTLS != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", node, nodeTLS)
+	} else {
+		conn, err = d.Dial("tcp", node)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mc, err := memcached.Wrap(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mc, nil
+}
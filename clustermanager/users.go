@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+// Users log in to the nodes with SASL. They are published to the nodes
+// with the map, with salted keys in place of their passwords, which only
+// nodes logged in with -nodePassword get. Once there is a user, nodes turn
+// away clients that haven't logged in.
+
+type userRequest struct {
+	Name     string            `json:"name"`
+	Password string            `json:"password,omitempty"`
+	Roles    map[string]string `json:"roles,omitempty"`
+}
+
+type userInfo struct {
+	Name  string            `json:"name"`
+	Roles map[string]string `json:"roles"`
+}
+
+// names starting with '@' are kept for the cluster's own users
+var validUserName = validBucketName
+
+func readUserRequest(w http.ResponseWriter, req *http.Request) (userRequest, bool) {
+	var ur userRequest
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "must be a POST")
+		return ur, false
+	}
+	if err := json.NewDecoder(req.Body).Decode(&ur); err != nil {
+		writeError(w, http.StatusBadRequest, "bad request body: "+err.Error())
+		return ur, false
+	}
+	if !validUserName.MatchString(ur.Name) {
+		writeError(w, http.StatusBadRequest, "user name must be 1 to 100 letters, digits, '_', '.' or '-'")
+		return ur, false
+	}
+	return ur, true
+}
+
+// SetUser creates a user or changes its password or roles, whichever are
+// given. A new user needs both
+func SetUser(w http.ResponseWriter, req *http.Request) {
+	ur, ok := readUserRequest(w, req)
+	if !ok {
+		return
+	}
+	if nodePassword == "" {
+		// the nodes couldn't fetch the users' keys
+		writeError(w, http.StatusBadRequest, "users need the managers started with -nodePassword")
+		return
+	}
+
+	for bucket, role := range ur.Roles {
+		if bucket != auth.AllBuckets && !validBucketName.MatchString(bucket) {
+			writeError(w, http.StatusBadRequest, "bad bucket name "+bucket)
+			return
+		}
+		if !auth.ValidRole(role) {
+			writeError(w, http.StatusBadRequest, "role must be read, readwrite or admin, not "+role)
+			return
+		}
+	}
+
+	// hashing takes a while, do it before taking the lock
+	var creds *auth.User
+	if ur.Password != "" {
+		var err error
+		if creds, err = auth.NewUser(ur.Password, nil); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	missing := false
+	cluster.update(func(tx *stateTx) {
+		m := tx.currentMap()
+		old, exists := m.Users[ur.Name]
+		if !exists && (creds == nil || ur.Roles == nil) {
+			missing = true
+			return
+		}
+
+		u := &auth.User{}
+		if exists {
+			*u = *old
+		}
+		if creds != nil {
+			u.Salt, u.Iterations, u.SHA256, u.SHA512 = creds.Salt, creds.Iterations, creds.SHA256, creds.SHA512
+		}
+		if ur.Roles != nil {
+			u.Roles = ur.Roles
+		}
+
+		next := m.clone()
+		next.Rev++
+		next.Users[ur.Name] = u
+		tx.publish(next)
+	})
+	if missing {
+		writeError(w, http.StatusBadRequest, "a new user needs a password and roles")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listUsers())
+}
+
+// DeleteUser removes a user, nodes turn away its connections once they
+// see the new map
+func DeleteUser(w http.ResponseWriter, req *http.Request) {
+	ur, ok := readUserRequest(w, req)
+	if !ok {
+		return
+	}
+
+	exists := false
+	cluster.update(func(tx *stateTx) {
+		m := tx.currentMap()
+		if _, exists = m.Users[ur.Name]; !exists {
+			return
+		}
+
+		next := m.clone()
+		next.Rev++
+		delete(next.Users, ur.Name)
+		tx.publish(next)
+	})
+	if !exists {
+		writeError(w, http.StatusNotFound, "no user "+ur.Name)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listUsers())
+}
+
+// ListUsers lists the users with their roles
+func ListUsers(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, listUsers())
+}
+
+func listUsers() []userInfo {
+	m := cluster.snapshot()
+	list := make([]userInfo, 0, len(m.Users))
+	for name, u := range m.Users {
+		list = append(list, userInfo{Name: name, Roles: u.Roles})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
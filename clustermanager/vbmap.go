@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/maniktaneja/luxstor/auth"
+)
+
+const defaultBucket = "default"
+
+// vbucket maps published to the nodes, one per bucket, along with the
+// users allowed in, and every change gets a new revision. Term is the
+// election term of the manager that took over the map last, a map from a
+// newer term wins over any revision of an older one. Users are replaced,
+// never modified, once published
+type clusterMap struct {
+	Term    uint64
+	Rev     uint64
+	Buckets map[string]*bucketMap
+	Users   map[string]*auth.User
+}
+
+// Every vbucket of a bucket lists its active node followed by its
+// replicas. Quota is the memory, in bytes, each node may use for the
+// bucket, 0 for no limit
+type bucketMap struct {
+	Quota    uint64     `json:"quota"`
+	Replicas int        `json:"replicas"`
+	VBuckets [][]string `json:"vbuckets"`
+}
+
+// a map with the default bucket laid out over servers
+func newClusterMap(servers []string, replicas int) *clusterMap {
+	return &clusterMap{
+		Rev:     1,
+		Buckets: map[string]*bucketMap{defaultBucket: newBucketMap(servers, 0, replicas)},
+	}
+}
+
+// lay the vbuckets out round robin over the servers, with the replicas
+// of a vbucket on the servers following its active node
+func newBucketMap(servers []string, quota uint64, replicas int) *bucketMap {
+	b := &bucketMap{Quota: quota, Replicas: replicas, VBuckets: make([][]string, vbucketCount)}
+	if len(servers) == 0 {
+		return b
+	}
+
+	if replicas > len(servers)-1 {
+		replicas = len(servers) - 1
+	}
+
+	for vb := 0; vb < vbucketCount; vb++ {
+		for r := 0; r <= replicas; r++ {
+			b.VBuckets[vb] = append(b.VBuckets[vb], servers[(vb+r)%len(servers)])
+		}
+	}
+	return b
+}
+
+func (m *clusterMap) clone() *clusterMap {
+	c := &clusterMap{
+		Term:    m.Term,
+		Rev:     m.Rev,
+		Buckets: make(map[string]*bucketMap, len(m.Buckets)),
+		Users:   make(map[string]*auth.User, len(m.Users)),
+	}
+	for name, b := range m.Buckets {
+		c.Buckets[name] = b.clone()
+	}
+	for name, u := range m.Users {
+		c.Users[name] = u
+	}
+	return c
+}
+
+func (b *bucketMap) clone() *bucketMap {
+	c := &bucketMap{Quota: b.Quota, Replicas: b.Replicas, VBuckets: make([][]string, len(b.VBuckets))}
+	for vb, nodes := range b.VBuckets {
+		c.VBuckets[vb] = append([]string(nil), nodes...)
+	}
+	return c
+}
+
+// bucket names in order
+func (m *clusterMap) bucketNames() []string {
+	names := make([]string, 0, len(m.Buckets))
+	for name := range m.Buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *clusterMap) String() string {
+	var buckets []string
+	for _, name := range m.bucketNames() {
+		buckets = append(buckets, name+"="+m.Buckets[name].String())
+	}
+	return strings.Join(buckets, " ")
+}
+
+// the map in the format understood by the nodes, vbuckets are separated
+// by "," and the nodes of a vbucket by ";"
+func (b *bucketMap) String() string {
+	vbuckets := make([]string, len(b.VBuckets))
+	for vb, nodes := range b.VBuckets {
+		vbuckets[vb] = strings.Join(nodes, ";")
+	}
+	return strings.Join(vbuckets, ",")
+}
+
+// servers that hold at least one vbucket of any bucket
+func (m *clusterMap) servers() []string {
+	seen := make(map[string]bool)
+	var servers []string
+	for _, name := range m.bucketNames() {
+		for _, nodes := range m.Buckets[name].VBuckets {
+			for _, node := range nodes {
+				if !seen[node] {
+					seen[node] = true
+					servers = append(servers, node)
+				}
+			}
+		}
+	}
+	return servers
+}
+
+// failover returns a new revision of the map without node. For every
+// vbucket where node was active its first replica is promoted
+func (m *clusterMap) failover(node string) *clusterMap {
+	next := m.clone()
+	next.Rev++
+
+	for _, name := range next.bucketNames() {
+		for vb, nodes := range next.Buckets[name].VBuckets {
+			var remaining []string
+			for _, n := range nodes {
+				if n != node {
+					remaining = append(remaining, n)
+				}
+			}
+
+			if len(remaining) == len(nodes) {
+				continue
+			}
+
+			if len(remaining) == 0 {
+				log.Printf("bucket %s vbucket %d has no replica left after failover of %s, its data is lost", name, vb, node)
+			} else if nodes[0] == node {
+				log.Printf("bucket %s vbucket %d: promoting replica %s to active", name, vb, remaining[0])
+			}
+			next.Buckets[name].VBuckets[vb] = remaining
+		}
+	}
+
+	return next
+}
+
+// newer reports whether a map at term, rev is newer than one at
+// term2, rev2
+func newer(term, rev, term2, rev2 uint64) bool {
+	return term > term2 || (term == term2 && rev > rev2)
+}
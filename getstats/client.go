@@ -9,8 +9,12 @@ import (
 
 var server = flag.String("server", "localhost", "server URL")
 var port = flag.Int("server port", 11212, "server port")
+var user = flag.String("user", "", "user to log in as")
+var password = flag.String("password", "", "password of the user")
+var group = flag.String("group", "", "stats group, connections lists the clients of the node")
 
 func main() {
+	flag.Parse()
 
 	memServer := fmt.Sprintf("%s:%d", *server, *port)
 
@@ -21,8 +25,14 @@ func main() {
 		log.Printf(" Unable to connect to %v, error %v", memServer, err)
 		return
 	}
+	if *user != "" {
+		if _, err := client.AuthScramSha(*user, *password); err != nil {
+			log.Printf(" Unable to log in as %v, error %v", *user, err)
+			return
+		}
+	}
 
-	res, err := client.GetAndTouch(0, "", 0)
+	res, err := client.GetAndTouch(0, *group, 0)
 	if err != nil {
 		log.Printf("Stats failed. Error %v", err)
 		return
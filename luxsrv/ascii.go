@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// The text protocol, for telnet and clients that don't speak binary.
+// Commands are turned into binary requests and go through the same
+// handlers. Client flags are accepted but not stored, values always come
+// back with flags 0. gets returns the CAS each write gives an item, there
+// is no cas command to use it with. There
+// is no SASL in the text protocol, so once auth is required it is refused
+// like any client that hasn't logged in
+
+// Largest value accepted by set, add and replace
+var asciiMaxItemSize = 20 * 1024 * 1024
+
+const maxKeyLength = 250
+
+func waitForAsciiConnections(ls *clientListener) {
+	log.Printf("Listening for the text protocol on %s", ls.Addr())
+	acceptLoop(ls, asciiConnectionHandler)
+}
+
+func asciiConnectionHandler(c *clientConn) {
+	conn, err := startConn(c)
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Dropping connection from %v: %v", c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+	defer conn.Close()
+
+	rh := &reqHandler{bucket: client.DefaultBucket, conn: c}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if !handleAsciiCommand(rh, strings.Fields(line), r, w) {
+			w.Flush()
+			return
+		}
+		c.idle()
+		// answer pipelined commands together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleAsciiCommand runs one command, returns false to close the
+// connection
+func handleAsciiCommand(rh *reqHandler, args []string, r *bufio.Reader, w *bufio.Writer) bool {
+	if len(args) == 0 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return true
+	}
+
+	noreply := args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	reply := func(format string, a ...interface{}) {
+		if !noreply {
+			fmt.Fprintf(w, format+"\r\n", a...)
+		}
+	}
+
+	for _, key := range args[1:] {
+		if len(key) > maxKeyLength {
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		}
+	}
+
+	switch cmd := args[0]; cmd {
+	case "get", "gets":
+		if len(args) < 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return true
+		}
+		for _, key := range args[1:] {
+			res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte(key)})
+			if res.Status == gomemcached.KEY_ENOENT {
+				continue
+			}
+			if res.Status != gomemcached.SUCCESS {
+				fmt.Fprintf(w, "%s\r\n", asciiError(res.Status))
+				return true
+			}
+			if cmd == "gets" {
+				fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n", key, len(res.Body), res.Cas)
+			} else {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(res.Body))
+			}
+			w.Write(res.Body)
+			w.WriteString("\r\n")
+		}
+		fmt.Fprint(w, "END\r\n")
+
+	case "set", "add", "replace":
+		// <cmd> <key> <flags> <exptime> <bytes>
+		if len(args) != 5 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return true
+		}
+		n, err := strconv.Atoi(args[4])
+		if err != nil || n < 0 {
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		}
+		if n > asciiMaxItemSize {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(n)+2); err != nil {
+				return false
+			}
+			reply("SERVER_ERROR object too large for cache")
+			return true
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return false
+		}
+		if string(data[n:]) != "\r\n" {
+			reply("CLIENT_ERROR bad data chunk")
+			return true
+		}
+
+		exp, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR bad command line format")
+			return true
+		}
+		extras := make([]byte, 8)
+		if exp < 0 {
+			// already expired. Small expirations are relative, the
+			// smallest absolute one is long past
+			exp = maxRelativeExpiry + 1
+		}
+		binary.BigEndian.PutUint32(extras[4:], uint32(exp))
+
+		opcodes := map[string]gomemcached.CommandCode{
+			"set":     gomemcached.SET,
+			"add":     gomemcached.ADD,
+			"replace": gomemcached.REPLACE,
+		}
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{
+			Opcode: opcodes[cmd],
+			Key:    []byte(args[1]),
+			Body:   data[:n],
+			Extras: extras,
+		})
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			reply("STORED")
+		case gomemcached.KEY_EEXISTS, gomemcached.KEY_ENOENT:
+			reply("NOT_STORED")
+		default:
+			reply("%s", asciiError(res.Status))
+		}
+
+	case "delete":
+		if len(args) < 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return true
+		}
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: []byte(args[1])})
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			reply("DELETED")
+		case gomemcached.KEY_ENOENT:
+			reply("NOT_FOUND")
+		default:
+			reply("%s", asciiError(res.Status))
+		}
+
+	case "incr", "decr":
+		if len(args) != 3 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return true
+		}
+		delta, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR invalid numeric delta argument")
+			return true
+		}
+		req := &gomemcached.MCRequest{Opcode: gomemcached.INCREMENT, Key: []byte(args[1]), Extras: make([]byte, 20)}
+		if cmd == "decr" {
+			req.Opcode = gomemcached.DECREMENT
+		}
+		binary.BigEndian.PutUint64(req.Extras, delta)
+		// don't create missing keys
+		binary.BigEndian.PutUint32(req.Extras[16:], 0xffffffff)
+
+		res := rh.HandleMessage(nil, req)
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			reply("%d", binary.BigEndian.Uint64(res.Body))
+		case gomemcached.KEY_ENOENT:
+			reply("NOT_FOUND")
+		case gomemcached.DELTA_BADVAL:
+			reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		default:
+			reply("%s", asciiError(res.Status))
+		}
+
+	case "stats":
+		req := &gomemcached.MCRequest{Opcode: gomemcached.GAT}
+		if len(args) > 1 {
+			req.Key = []byte(args[1])
+		}
+		res := rh.HandleMessage(nil, req)
+		if res.Status == gomemcached.KEY_ENOENT {
+			fmt.Fprint(w, "ERROR\r\n")
+			return true
+		} else if res.Status != gomemcached.SUCCESS {
+			fmt.Fprintf(w, "%s\r\n", asciiError(res.Status))
+			return true
+		}
+		for _, stat := range strings.Split(string(res.Body), "\n") {
+			if stat != "" {
+				fmt.Fprintf(w, "STAT %s\r\n", stat)
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+
+	case "flush_all":
+		req := &gomemcached.MCRequest{Opcode: gomemcached.FLUSH, Extras: make([]byte, 4)}
+		if len(args) > 1 {
+			delay, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				reply("CLIENT_ERROR bad command line format")
+				return true
+			}
+			binary.BigEndian.PutUint32(req.Extras, uint32(delay))
+		}
+		res := rh.HandleMessage(nil, req)
+		if res.Status == gomemcached.SUCCESS {
+			reply("OK")
+		} else {
+			reply("%s", asciiError(res.Status))
+		}
+
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", version)
+
+	case "quit":
+		return false
+
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return true
+}
+
+// the text protocol's answer to a failed request
+func asciiError(status gomemcached.Status) string {
+	switch status {
+	case gomemcached.EACCESS:
+		return "CLIENT_ERROR access denied"
+	case gomemcached.ENOMEM:
+		return "SERVER_ERROR out of memory storing object"
+	case gomemcached.NOT_MY_VBUCKET:
+		return "SERVER_ERROR not my vbucket"
+	case gomemcached.TMPFAIL:
+		return "SERVER_ERROR temporary failure"
+	case gomemcached.NO_BUCKET:
+		return "SERVER_ERROR no bucket"
+	}
+	return "SERVER_ERROR " + status.String()
+}
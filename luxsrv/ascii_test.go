@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// a fresh default bucket. Without a map this node owns every key
+func setupBucket(t *testing.T) *luxStor {
+	initSlots(2)
+	bucketsLock.Lock()
+	buckets = make(map[string]*luxStor)
+	bucketsLock.Unlock()
+	syncBuckets()
+	return getBucket(client.DefaultBucket)
+}
+
+// run text protocol commands and return the replies
+func asciiSession(input string) string {
+	rh := &reqHandler{bucket: client.DefaultBucket}
+	r := bufio.NewReader(strings.NewReader(input))
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil || !handleAsciiCommand(rh, strings.Fields(line), r, w) {
+			break
+		}
+	}
+	w.Flush()
+	return out.String()
+}
+
+func TestAsciiCommands(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"set and get", "set k 5 0 2\r\nhi\r\nget k missing\r\n",
+			"STORED\r\nVALUE k 0 2\r\nhi\r\nEND\r\n"},
+		{"binary safe value", "set k 0 0 4\r\na\r\nb\r\nget k\r\n",
+			"STORED\r\nVALUE k 0 4\r\na\r\nb\r\nEND\r\n"},
+		{"negative exptime", "set k 0 0 1\r\na\r\nset k 0 -1 1\r\nb\r\nget k\r\n",
+			"STORED\r\nSTORED\r\nEND\r\n"},
+		{"add and replace", "add k 0 0 1\r\na\r\nadd k 0 0 1\r\nb\r\nreplace other 0 0 1\r\nc\r\nget k\r\n",
+			"STORED\r\nNOT_STORED\r\nNOT_STORED\r\nVALUE k 0 1\r\na\r\nEND\r\n"},
+		{"noreply", "set k 0 0 1 noreply\r\nx\r\ndelete k noreply\r\nget k\r\n",
+			"END\r\n"},
+		{"delete", "set k 0 0 1\r\nx\r\ndelete k\r\ndelete k\r\n",
+			"STORED\r\nDELETED\r\nNOT_FOUND\r\n"},
+		{"incr and decr", "set n 0 0 1\r\n5\r\nincr n 3\r\ndecr n 10\r\nincr missing 1\r\n",
+			"STORED\r\n8\r\n0\r\nNOT_FOUND\r\n"},
+		{"incr non-numeric", "set s 0 0 1\r\nx\r\nincr s 1\r\nincr s x\r\n",
+			"STORED\r\nCLIENT_ERROR cannot increment or decrement non-numeric value\r\nCLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"bad data chunk", "set k 0 0 1\r\nabc\r\n",
+			"CLIENT_ERROR bad data chunk\r\nERROR\r\n"},
+		{"bad exptime", "set k 0 x 1\r\na\r\n",
+			"CLIENT_ERROR bad command line format\r\n"},
+		{"bad length", "set k 0 0 -1\r\n",
+			"CLIENT_ERROR bad command line format\r\n"},
+		{"missing arguments", "set k 0 0\r\nget\r\n\r\n",
+			"ERROR\r\nERROR\r\nERROR\r\n"},
+		{"long key", "get " + strings.Repeat("k", maxKeyLength+1) + "\r\n",
+			"CLIENT_ERROR bad command line format\r\n"},
+		{"gets", "set k 0 0 1\r\na\r\nset j 0 0 1\r\nb\r\nset k 0 0 1\r\nc\r\ngets k j missing\r\n",
+			"STORED\r\nSTORED\r\nSTORED\r\nVALUE k 0 1 3\r\nc\r\nVALUE j 0 1 2\r\nb\r\nEND\r\n"},
+		{"quit", "quit\r\nget k\r\n",
+			""},
+	}
+
+	for _, test := range tests {
+		setupBucket(t)
+		if got := asciiSession(test.input); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/auth"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// Clients log in with SASL as one of the users published by the cluster
+// manager, or as the node user with the -nodePassword shared by the
+// cluster. Every request then needs a role on the connection's bucket.
+// Until the cluster has users, or -requireAuth is given, anyone may do
+// anything.
+
+// the node user, nil if there is no node password
+var nodeUser *auth.User
+
+// role needed for each opcode, everything else needs readwrite
+var opRoles = map[gomemcached.CommandCode]string{
+	gomemcached.GET:         auth.Read,
+	gomemcached.GETQ:        auth.Read,
+	gomemcached.GETK:        auth.Read,
+	gomemcached.GETKQ:       auth.Read,
+	gomemcached.GAT:         auth.Read,
+	gomemcached.STAT:        auth.Read,
+	gomemcached.VERSION:     auth.Read,
+	gomemcached.FLUSH:       auth.Admin,
+	gomemcached.FLUSHQ:      auth.Admin,
+	gomemcached.SET_VBUCKET: auth.Admin,
+}
+
+func initAuth(password string) {
+	if password == "" {
+		return
+	}
+	u, err := auth.NewUser(password, map[string]string{auth.AllBuckets: auth.Admin})
+	if err != nil {
+		log.Fatalf("Cannot set up the node user: %v", err)
+	}
+	nodeUser = u
+}
+
+func lookupUser(name string) *auth.User {
+	if name == auth.NodeUser {
+		return nodeUser
+	}
+	return client.GetUser(name)
+}
+
+func authRequired() bool {
+	return *requireAuth || client.AuthRequired()
+}
+
+// handle SASL_LIST_MECHS, SASL_AUTH and SASL_STEP
+func handleSasl(req *gomemcached.MCRequest, rh *reqHandler) *gomemcached.MCResponse {
+	mech := string(req.Key)
+	switch {
+	case req.Opcode == gomemcached.SASL_LIST_MECHS:
+		return &gomemcached.MCResponse{Body: []byte(auth.Mechanisms)}
+
+	case req.Opcode == gomemcached.SASL_AUTH && mech == "PLAIN":
+		rh.user, rh.scram = "", nil
+		name, password, err := auth.Plain(req.Body)
+		if err != nil {
+			return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+		}
+		if u := lookupUser(name); u == nil || !u.CheckPassword(password) {
+			return authFailed(name)
+		}
+		rh.user = name
+		return &gomemcached.MCResponse{Body: []byte("Authenticated")}
+
+	case req.Opcode == gomemcached.SASL_AUTH:
+		rh.user, rh.scram = "", nil
+		s, err := auth.NewScram(mech)
+		if err != nil {
+			return &gomemcached.MCResponse{Status: gomemcached.AUTH_ERROR, Body: []byte(err.Error())}
+		}
+		serverFirst, err := s.Start(req.Body, lookupUser)
+		if err != nil {
+			return &gomemcached.MCResponse{Status: gomemcached.EINVAL, Body: []byte(err.Error())}
+		}
+		rh.scram = s
+		return &gomemcached.MCResponse{Status: gomemcached.AUTH_CONTINUE, Body: serverFirst}
+
+	case rh.scram != nil:
+		s := rh.scram
+		rh.scram = nil
+		serverFinal, err := s.Finish(req.Body)
+		if err != nil {
+			return authFailed(s.User())
+		}
+		rh.user = s.User()
+		return &gomemcached.MCResponse{Body: serverFinal}
+	}
+	return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+}
+
+func authFailed(name string) *gomemcached.MCResponse {
+	log.Printf("Authentication failed for user %s", name)
+	return &gomemcached.MCResponse{Status: gomemcached.AUTH_ERROR, Body: []byte("Auth failure")}
+}
+
+// allowed reports whether the connection's user has role on bucket. The
+// user is looked up on every request, so a deleted user or a taken away
+// role takes effect on open connections too
+func (rh *reqHandler) allowed(bucket, role string) bool {
+	if !authRequired() {
+		return true
+	}
+	u := lookupUser(rh.user)
+	return u != nil && u.Allowed(bucket, role)
+}
+
+// authorize returns EACCESS if the request isn't allowed. NOOPs are
+// always allowed, they are used for health checks
+func (rh *reqHandler) authorize(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.Opcode == gomemcached.NOOP {
+		return nil
+	}
+	role, ok := opRoles[req.Opcode]
+	if !ok {
+		role = auth.ReadWrite
+	}
+	if !rh.allowed(rh.bucket, role) {
+		return &gomemcached.MCResponse{Status: gomemcached.EACCESS}
+	}
+	return nil
+}
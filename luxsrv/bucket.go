@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/auth"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// Every bucket has its own store. Buckets are created when they show up
+// in the cluster map and dropped, with their data, when they leave it.
+// Until a map is received there is only the default bucket
+
+// rough per item overhead counted against a bucket's quota
+const itemOverhead = 64
+
+var bucketsLock sync.RWMutex
+var buckets = make(map[string]*luxStor)
+
+// getBucket returns the store of a bucket, nil if there is no such bucket
+func getBucket(name string) *luxStor {
+	bucketsLock.RLock()
+	defer bucketsLock.RUnlock()
+	return buckets[name]
+}
+
+// keep the buckets in line with the cluster map
+func watchBuckets() {
+	for {
+		changed := client.Changed()
+		syncBuckets()
+		<-changed
+	}
+}
+
+func syncBuckets() {
+	cfg := client.GetBuckets()
+	if client.GetRev() == 0 {
+		cfg = map[string]client.Bucket{client.DefaultBucket: {}}
+	}
+
+	bucketsLock.Lock()
+	defer bucketsLock.Unlock()
+
+	for name, b := range cfg {
+		s, ok := buckets[name]
+		if !ok {
+			log.Printf("Creating bucket %s, quota %d", name, b.Quota)
+			s = initMemdb(name)
+			buckets[name] = s
+		}
+		atomic.StoreUint64(&s.quota, b.Quota)
+	}
+
+	for name := range buckets {
+		if _, ok := cfg[name]; !ok {
+			log.Printf("Dropping bucket %s", name)
+			delete(buckets, name)
+		}
+	}
+}
+
+func itemSize(key, value []byte) uint64 {
+	return uint64(len(key) + len(value) + itemOverhead)
+}
+
+// reserve room for an item in the bucket's quota. freed is the room of
+// the version it replaces, given back when the item is put, so a value no
+// larger than the old one always fits. Concurrent writers retry until
+// their check and their reservation see the same usage
+func (s *luxStor) reserve(key, value []byte, freed uint64) bool {
+	size := itemSize(key, value)
+	for {
+		used := atomic.LoadUint64(&s.used)
+		quota := atomic.LoadUint64(&s.quota)
+		if quota > 0 && used+size > quota+freed {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&s.used, used, used+size) {
+			return true
+		}
+	}
+}
+
+// give back the room of an item that was overwritten or deleted
+func (s *luxStor) release(key, value []byte) {
+	atomic.AddUint64(&s.used, ^(itemSize(key, value) - 1))
+}
+
+// select the bucket the following requests of a connection go to, the
+// user needs a role on it
+func handleSelectBucket(req *gomemcached.MCRequest, rh *reqHandler) *gomemcached.MCResponse {
+	name := string(req.Key)
+	if !rh.allowed(name, auth.Read) {
+		return &gomemcached.MCResponse{Status: gomemcached.EACCESS}
+	}
+	if getBucket(name) == nil {
+		return &gomemcached.MCResponse{Status: gomemcached.NO_BUCKET}
+	}
+	rh.bucket = name
+	return &gomemcached.MCResponse{Status: gomemcached.SUCCESS}
+}
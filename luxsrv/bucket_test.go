@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// writers racing for the last of the quota never take more than it
+func TestReserveQuota(t *testing.T) {
+	s := &luxStor{quota: 100 * (itemOverhead + 2)}
+
+	var wg sync.WaitGroup
+	var reserved int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if s.reserve([]byte("k"), []byte("v"), 0) {
+					atomic.AddInt64(&reserved, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 100 || s.used != s.quota {
+		t.Errorf("reserved %d items, %d of %d bytes", reserved, s.used, s.quota)
+	}
+}
+
+// a full bucket still takes overwrites that are no larger
+func TestOverwriteFullBucket(t *testing.T) {
+	s := setupBucket(t)
+	asciiSession("set k 0 0 2\r\nab\r\n")
+	atomic.StoreUint64(&s.quota, atomic.LoadUint64(&s.used))
+
+	got := asciiSession("set k 0 0 2\r\ncd\r\nset k 0 0 1\r\ne\r\nset k 0 0 2\r\nfg\r\nset k 0 0 3\r\nfgh\r\nset j 0 0 1\r\ni\r\nget k\r\n")
+	want := "STORED\r\nSTORED\r\nSTORED\r\n" + strings.Repeat("SERVER_ERROR out of memory storing object\r\n", 2) +
+		"VALUE k 0 2\r\nfg\r\nEND\r\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
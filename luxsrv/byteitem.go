@@ -3,13 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"time"
 )
 
+// an item is laid out as key length, expiration, CAS, key and value. The
+// expiration is in unix seconds, 0 for items that don't expire
 type byteItem []byte
 
-func newByteItem(k, v []byte) byteItem {
-	b := make([]byte, 2, 2+len(k)+len(v))
+const itemHeader = 14
+
+func newByteItem(k, v []byte, exp uint32, cas uint64) byteItem {
+	b := make([]byte, itemHeader, itemHeader+len(k)+len(v))
 	binary.LittleEndian.PutUint16(b[0:2], uint16(len(k)))
+	binary.LittleEndian.PutUint32(b[2:6], exp)
+	binary.LittleEndian.PutUint64(b[6:14], cas)
 	b = append(b, k...)
 	b = append(b, v...)
 
@@ -19,12 +26,12 @@ func newByteItem(k, v []byte) byteItem {
 func (b *byteItem) valOffset() int {
 	buf := []byte(*b)
 	l := binary.LittleEndian.Uint16(buf[0:2])
-	return 2 + int(l)
+	return itemHeader + int(l)
 }
 
 func (b *byteItem) Key() []byte {
 	buf := []byte(*b)
-	return buf[2:b.valOffset()]
+	return buf[itemHeader:b.valOffset()]
 }
 
 func (b *byteItem) Value() []byte {
@@ -32,12 +39,47 @@ func (b *byteItem) Value() []byte {
 	return buf[b.valOffset():]
 }
 
+func (b *byteItem) Expiry() uint32 {
+	buf := []byte(*b)
+	return binary.LittleEndian.Uint32(buf[2:6])
+}
+
+func (b *byteItem) Cas() uint64 {
+	buf := []byte(*b)
+	return binary.LittleEndian.Uint64(buf[6:14])
+}
+
+func (b *byteItem) Expired() bool {
+	exp := b.Expiry()
+	return exp != 0 && int64(exp) <= time.Now().Unix()
+}
+
 func byteItemKeyCompare(a, b []byte) int {
 	itm1 := byteItem(a)
 	itm2 := byteItem(b)
 
-	k1 := []byte(itm1)[2:itm1.valOffset()]
-	k2 := []byte(itm2)[2:itm2.valOffset()]
+	k1 := []byte(itm1)[itemHeader:itm1.valOffset()]
+	k2 := []byte(itm2)[itemHeader:itm2.valOffset()]
 
 	return bytes.Compare(k1, k2)
 }
+
+// expirations of 30 days or less are relative to now, as in memcached
+const maxRelativeExpiry = 30 * 24 * 3600
+
+// absExpiry turns the expiration a client sent into unix seconds
+func absExpiry(exp uint32) uint32 {
+	if exp == 0 || exp > maxRelativeExpiry {
+		return exp
+	}
+	return uint32(time.Now().Unix()) + exp
+}
+
+// ttlExpiry turns a time to live in seconds into the expiration of a set,
+// longer ones than memcached takes as relative are sent as unix time
+func ttlExpiry(secs int64) uint32 {
+	if secs > maxRelativeExpiry {
+		secs += time.Now().Unix()
+	}
+	return uint32(secs)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client connections are accepted through a clientListener, which refuses
+// them past -maxConns and keeps each one in conns with its counters until
+// it is closed. Reads time out after -idleTimeout waiting for a request
+// and after -readTimeout once a request has started, the http server sets
+// its own deadlines
+
+var connsLock sync.Mutex
+var conns = make(map[*clientConn]bool)
+var lastConnID uint64
+
+// at most one refused connection is logged per second
+var lastRefusedLog int64
+
+type clientConn struct {
+	net.Conn
+	id       uint64
+	protocol string
+	since    time.Time
+	timeouts bool // set once the connection is ready for requests
+
+	bytesIn  uint64
+	bytesOut uint64
+	ops      uint64
+	busy     int32 // bytes of a request have been read and it is not answered yet
+
+	closeOnce sync.Once
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if c.timeouts {
+		c.setReadDeadline()
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.bytesIn, uint64(n))
+		atomic.StoreInt32(&c.busy, 1)
+	}
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	return n, err
+}
+
+// Close may be called more than once and never fails, HandleIO panics if
+// it does
+func (c *clientConn) Close() error {
+	c.closeOnce.Do(func() {
+		removeConn(c)
+		c.Conn.Close()
+	})
+	return nil
+}
+
+func (c *clientConn) setReadDeadline() {
+	busy := atomic.LoadInt32(&c.busy) != 0
+	timeout := *idleTimeout
+	if busy {
+		timeout = *readTimeout
+	}
+	switch {
+	case isShuttingDown() && !busy:
+		c.Conn.SetReadDeadline(time.Now())
+	case timeout > 0:
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	default:
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// serving arms the idle and read timeouts once a handshake is over
+func (c *clientConn) serving() {
+	atomic.StoreInt32(&c.busy, 0)
+	c.timeouts = true
+}
+
+// requestDone counts a request, the next read waits for another one
+func (c *clientConn) requestDone() {
+	atomic.AddUint64(&c.ops, 1)
+	atomic.StoreInt32(&c.busy, 0)
+}
+
+// idle marks a connection of the text protocols as waiting for its next
+// command, commands like version or ping are answered without a request
+func (c *clientConn) idle() {
+	atomic.StoreInt32(&c.busy, 0)
+}
+
+// drain stops a connection once it has no request in progress
+func (c *clientConn) drain() {
+	if atomic.LoadInt32(&c.busy) == 0 {
+		c.Conn.SetReadDeadline(time.Now())
+	}
+}
+
+// addConn registers a new connection, false if there are too many
+func addConn(c *clientConn) bool {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if *maxConns > 0 && len(conns) >= *maxConns {
+		return false
+	}
+	conns[c] = true
+	cs := connStats[c.protocol]
+	atomic.AddInt64(&cs.open, 1)
+	atomic.AddUint64(&cs.total, 1)
+	return true
+}
+
+func removeConn(c *clientConn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	if conns[c] {
+		delete(conns, c)
+		atomic.AddInt64(&connStats[c.protocol].open, -1)
+	}
+}
+
+func openConns() int {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	return len(conns)
+}
+
+type clientListener struct {
+	net.Listener
+	protocol string
+}
+
+// accept returns the next connection there is room for
+func (l *clientListener) accept() (*clientConn, error) {
+	for {
+		s, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c := &clientConn{
+			Conn:     s,
+			id:       atomic.AddUint64(&lastConnID, 1),
+			protocol: l.protocol,
+			since:    time.Now(),
+		}
+		if addConn(c) {
+			if isShuttingDown() {
+				// accepted just before the listener was closed
+				c.drain()
+			}
+			return c, nil
+		}
+		if now := time.Now().Unix(); atomic.SwapInt64(&lastRefusedLog, now) != now {
+			log.Printf("Refusing connection from %v, already %d open", s.RemoteAddr(), *maxConns)
+		}
+		s.Close()
+	}
+}
+
+// Accept lets the http server use the listener
+func (l *clientListener) Accept() (net.Conn, error) {
+	c, err := l.accept()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// acceptLoop hands every connection to handle until shutdown. Failed
+// accepts, out of file descriptors most likely, back off up to a second
+// instead of spinning
+func acceptLoop(ls *clientListener, handle func(c *clientConn)) {
+	var backoff time.Duration
+	for {
+		c, err := ls.accept()
+		if err == nil {
+			backoff = 0
+			go handle(c)
+			continue
+		}
+		if isShuttingDown() {
+			return
+		}
+		if backoff == 0 {
+			backoff = 5 * time.Millisecond
+		} else if backoff *= 2; backoff > time.Second {
+			backoff = time.Second
+		}
+		log.Printf("Error accepting from %s: %v, retrying in %v", ls.Addr(), err, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// connectionStats returns the "connections" stats group, the counters of
+// every open connection
+func connectionStats() []string {
+	connsLock.Lock()
+	list := make([]*clientConn, 0, len(conns))
+	for c := range conns {
+		list = append(list, c)
+	}
+	connsLock.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+
+	var stats []string
+	for _, c := range list {
+		prefix := fmt.Sprintf("conn:%d:", c.id)
+		stats = append(stats,
+			fmt.Sprintf("%saddr %v", prefix, c.RemoteAddr()),
+			fmt.Sprintf("%sprotocol %s", prefix, c.protocol),
+			fmt.Sprintf("%sbytes_in %d", prefix, atomic.LoadUint64(&c.bytesIn)),
+			fmt.Sprintf("%sbytes_out %d", prefix, atomic.LoadUint64(&c.bytesOut)),
+			fmt.Sprintf("%sops %d", prefix, atomic.LoadUint64(&c.ops)),
+			fmt.Sprintf("%sconnected_secs %d", prefix, int64(time.Since(c.since).Seconds())))
+	}
+	return stats
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a text protocol listener serving until the test ends, when the
+// connections of the test are closed
+func startTextServer(t *testing.T) string {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ls.Close()
+		waitForConns(t, 0)
+	})
+	cl := &clientListener{Listener: ls, protocol: "text"}
+	go func() {
+		for {
+			c, err := cl.accept()
+			if err != nil {
+				return
+			}
+			go asciiConnectionHandler(c)
+		}
+	}()
+	return ls.Addr().String()
+}
+
+type textClient struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dialText(t *testing.T, addr string) *textClient {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return &textClient{c, bufio.NewReader(c)}
+}
+
+// send a command and read one line of the answer, "" once the server has
+// closed the connection
+func (c *textClient) call(cmd string) string {
+	c.Write([]byte(cmd))
+	line, _ := c.r.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// true once the server closes the connection
+func (c *textClient) closed() bool {
+	_, err := c.r.ReadByte()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func waitForConns(t *testing.T, n int) {
+	for deadline := time.Now().Add(5 * time.Second); openConns() != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections open, want %d", openConns(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	setupBucket(t)
+	n := *maxConns
+	t.Cleanup(func() { *maxConns = n })
+	*maxConns = 2
+	addr := startTextServer(t)
+
+	a, b := dialText(t, addr), dialText(t, addr)
+	if a.call("version\r\n") != "VERSION "+version || b.call("version\r\n") != "VERSION "+version {
+		t.Fatalf("connections under the limit not served")
+	}
+	if c := dialText(t, addr); c.call("version\r\n") != "" {
+		t.Errorf("connection over the limit served")
+	}
+
+	// room for another once one is closed
+	a.Close()
+	waitForConns(t, 1)
+	if c := dialText(t, addr); c.call("version\r\n") != "VERSION "+version {
+		t.Errorf("connection refused after one was closed")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	setupBucket(t)
+	d := *idleTimeout
+	t.Cleanup(func() { *idleTimeout = d })
+	*idleTimeout = 200 * time.Millisecond
+	addr := startTextServer(t)
+
+	c := dialText(t, addr)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		// requests keep the connection open past the timeout
+		time.Sleep(100 * time.Millisecond)
+		if c.call("version\r\n") != "VERSION "+version {
+			t.Fatalf("busy connection closed after %v", time.Since(start))
+		}
+	}
+	if !c.closed() {
+		t.Errorf("idle connection not closed")
+	}
+}
+
+// on a listener taking TLS, a client that sends nothing doesn't keep its
+// connection either
+func TestSilentClient(t *testing.T) {
+	setupBucket(t)
+	d := *idleTimeout
+	t.Cleanup(func() { *idleTimeout, serverTLS = d, nil })
+	*idleTimeout = 100 * time.Millisecond
+	serverTLS = &tls.Config{}
+	addr := startTextServer(t)
+
+	c := dialText(t, addr)
+	waitForConns(t, 1)
+	if !c.closed() {
+		t.Errorf("silent connection not closed")
+	}
+}
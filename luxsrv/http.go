@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/auth"
+	"github.com/maniktaneja/luxstor/clusterclient"
+	"github.com/maniktaneja/luxstor/memstore"
+)
+
+// The REST api of a node, for debugging with curl:
+//
+//	GET, PUT, DELETE /kv/<key>[?ttl=seconds]
+//	GET /kv?start=&end=&limit=     keys owned by this node, in order,
+//	                               &base64=true for start and end in base64
+//	GET, POST /snapshots           list or create snapshots
+//	POST /snapshots/<n>/rollback
+//	GET /stats
+//	GET /metrics                   prometheus metrics, no login needed
+//
+// Requests are turned into binary ones and go through the same handlers,
+// so keys of other nodes are proxied and writes replicated. ?bucket=
+// picks the bucket, users log in with basic auth
+
+// Most items returned by a listing, and the default limit
+var httpMaxList = 10000
+var httpDefaultList = 100
+
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// an item as listed or written to a snapshot file. Keys and values that
+// are not valid utf-8 are in base64 and Base64 is set
+type kvItem struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Exp    uint32 `json:"exp,omitempty"` // unix seconds
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+func newKVItem(key, value []byte, exp uint32) kvItem {
+	if utf8.Valid(key) && utf8.Valid(value) {
+		return kvItem{Key: string(key), Value: string(value), Exp: exp}
+	}
+	return kvItem{
+		Key:    base64.StdEncoding.EncodeToString(key),
+		Value:  base64.StdEncoding.EncodeToString(value),
+		Exp:    exp,
+		Base64: true,
+	}
+}
+
+type kvList struct {
+	Items      []kvItem `json:"items"`
+	Next       string   `json:"next,omitempty"` // start of the next page
+	NextBase64 bool     `json:"nextBase64,omitempty"`
+}
+
+// setNext sets the start of the next page, in base64 unless it is utf-8
+func (l *kvList) setNext(key []byte) {
+	if utf8.Valid(key) {
+		l.Next = string(key)
+		return
+	}
+	l.Next = base64.StdEncoding.EncodeToString(key)
+	l.NextBase64 = true
+}
+
+type snapshotInfo struct {
+	Snapshot uint32 `json:"snapshot"`
+	Items    int64  `json:"items"`
+}
+
+type httpServer struct{}
+
+func serveHTTP(ls *clientListener) {
+	hs := &httpServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv", hs.List)
+	mux.HandleFunc("/kv/", hs.KV)
+	mux.HandleFunc("/snapshots", hs.Snapshots)
+	mux.HandleFunc("/snapshots/", hs.Snapshot)
+	mux.HandleFunc("/stats", hs.Stats)
+	mux.HandleFunc("/metrics", hs.Metrics)
+
+	server := &http.Server{
+		Handler:     mux,
+		ConnState:   httpConnState,
+		ReadTimeout: *readTimeout,
+		IdleTimeout: *idleTimeout,
+	}
+	httpSrv = server
+	var err error
+	if serverTLS != nil {
+		log.Printf("Serving https on %s", ls.Addr())
+		server.TLSConfig = serverTLS
+		err = server.ServeTLS(ls, "", "")
+	} else {
+		log.Printf("Serving http on %s", ls.Addr())
+		err = server.Serve(ls)
+	}
+	if !isShuttingDown() {
+		log.Fatalf("http server stopped: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="luxstor"`)
+	}
+	writeJSON(w, status, httpError{Error: msg})
+}
+
+// writeFailure answers a request that failed with status
+func writeFailure(w http.ResponseWriter, res *gomemcached.MCResponse, rh *reqHandler) {
+	msg := res.Status.String()
+	if len(res.Body) > 0 {
+		msg += ": " + string(res.Body)
+	}
+	code := http.StatusInternalServerError
+	switch res.Status {
+	case gomemcached.EACCESS:
+		code = http.StatusForbidden
+		if rh.user == "" {
+			code = http.StatusUnauthorized
+		}
+	case gomemcached.KEY_ENOENT, gomemcached.NO_BUCKET:
+		code = http.StatusNotFound
+	case gomemcached.KEY_EEXISTS:
+		code = http.StatusConflict
+	case gomemcached.EINVAL:
+		code = http.StatusBadRequest
+	case gomemcached.E2BIG:
+		code = http.StatusRequestEntityTooLarge
+	case gomemcached.ENOMEM:
+		code = http.StatusInsufficientStorage
+	case gomemcached.TMPFAIL, gomemcached.NOT_MY_VBUCKET:
+		code = http.StatusServiceUnavailable
+	}
+	writeError(w, code, msg)
+}
+
+// every request logs in again, passwords that checked out are remembered
+var httpLogins auth.Logins
+
+// handler returns the request handler of an http request, logged in and
+// in the bucket it asked for, nil if it has been answered
+func (hs *httpServer) handler(w http.ResponseWriter, req *http.Request) *reqHandler {
+	rh := &reqHandler{bucket: client.DefaultBucket}
+	if name, password, ok := req.BasicAuth(); ok {
+		if u := lookupUser(name); u == nil || !httpLogins.CheckPassword(name, u, password) {
+			authFailed(name)
+			writeError(w, http.StatusUnauthorized, "bad user name or password")
+			return nil
+		}
+		rh.user = name
+	}
+	if bucket := req.URL.Query().Get("bucket"); bucket != "" {
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.SELECT_BUCKET, Key: []byte(bucket)})
+		if res.Status != gomemcached.SUCCESS {
+			writeFailure(w, res, rh)
+			return nil
+		}
+	}
+	return rh
+}
+
+// KV gets, puts and deletes /kv/<key>
+func (hs *httpServer) KV(w http.ResponseWriter, req *http.Request) {
+	key := []byte(strings.TrimPrefix(req.URL.Path, "/kv/"))
+	if len(key) == 0 {
+		hs.List(w, req)
+		return
+	}
+	if len(key) > maxKeyLength {
+		writeError(w, http.StatusBadRequest, "key too long")
+		return
+	}
+	rh := hs.handler(w, req)
+	if rh == nil {
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: key})
+		if res.Status != gomemcached.SUCCESS {
+			writeFailure(w, res, rh)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(res.Body)))
+		w.Write(res.Body)
+
+	case "PUT", "POST":
+		value, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(asciiMaxItemSize)+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "reading the value: "+err.Error())
+			return
+		}
+		if len(value) > asciiMaxItemSize {
+			writeError(w, http.StatusRequestEntityTooLarge, "value too large")
+			return
+		}
+		set := &gomemcached.MCRequest{Opcode: gomemcached.SET, Key: key, Body: value, Extras: make([]byte, 8)}
+		if ttl := req.URL.Query().Get("ttl"); ttl != "" {
+			secs, err := strconv.ParseInt(ttl, 10, 64)
+			if err != nil || secs <= 0 || secs > 1<<31 {
+				writeError(w, http.StatusBadRequest, "ttl must be a number of seconds")
+				return
+			}
+			binary.BigEndian.PutUint32(set.Extras[4:], ttlExpiry(secs))
+		}
+		res := rh.HandleMessage(nil, set)
+		if res.Status != gomemcached.SUCCESS {
+			writeFailure(w, res, rh)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: key})
+		if res.Status != gomemcached.SUCCESS {
+			writeFailure(w, res, rh)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "must be a GET, PUT or DELETE")
+	}
+}
+
+// List returns the keys in [start, end) owned by this node with their
+// values. Next is set when there are more, it is the start of the next
+// page
+func (hs *httpServer) List(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "must be a GET")
+		return
+	}
+	q := req.URL.Query()
+	start, end := []byte(q.Get("start")), []byte(q.Get("end"))
+	if q.Get("base64") == "true" {
+		var err1, err2 error
+		start, err1 = base64.StdEncoding.DecodeString(q.Get("start"))
+		end, err2 = base64.StdEncoding.DecodeString(q.Get("end"))
+		if err1 != nil || err2 != nil {
+			writeError(w, http.StatusBadRequest, "start and end must be base64")
+			return
+		}
+	}
+	limit := httpDefaultList
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > httpMaxList {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be 1 to %d", httpMaxList))
+			return
+		}
+	}
+
+	rh := hs.handler(w, req)
+	if rh == nil {
+		return
+	}
+	if !rh.allowed(rh.bucket, auth.Read) {
+		writeFailure(w, &gomemcached.MCResponse{Status: gomemcached.EACCESS}, rh)
+		return
+	}
+	s := getBucket(rh.bucket)
+	if s == nil {
+		writeFailure(w, &gomemcached.MCResponse{Status: gomemcached.NO_BUCKET}, rh)
+		return
+	}
+	var snap *memstore.Snapshot
+	if sn := q.Get("snapshot"); sn != "" {
+		n, err := strconv.ParseUint(sn, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "snapshot must be a number")
+			return
+		}
+		if snap = s.openSnapshot(uint32(n)); snap == nil {
+			writeError(w, http.StatusNotFound, "no such snapshot")
+			return
+		}
+	} else {
+		snap = s.memdb.NewSnapshot()
+	}
+	defer snap.Close()
+	writeJSON(w, http.StatusOK, s.list(snap, start, end, limit))
+}
+
+// admin sends an admin command, the key of a SET_VBUCKET
+func (hs *httpServer) admin(w http.ResponseWriter, req *http.Request, cmd string) (*gomemcached.MCResponse, bool) {
+	rh := hs.handler(w, req)
+	if rh == nil {
+		return nil, false
+	}
+	res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.SET_VBUCKET, Key: []byte(cmd)})
+	if res.Status != gomemcached.SUCCESS {
+		writeFailure(w, res, rh)
+		return nil, false
+	}
+	return res, true
+}
+
+// Snapshots lists the snapshots of the bucket, or creates one on a POST
+func (hs *httpServer) Snapshots(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		res, ok := hs.admin(w, req, "list-snapshots")
+		if !ok {
+			return
+		}
+		snaps := []snapshotInfo{}
+		for _, line := range strings.Split(string(res.Body), "\n") {
+			var si snapshotInfo
+			if _, err := fmt.Sscanf(line, "%d %d", &si.Snapshot, &si.Items); err == nil {
+				snaps = append(snaps, si)
+			}
+		}
+		writeJSON(w, http.StatusOK, snaps)
+
+	case "POST":
+		res, ok := hs.admin(w, req, "create-snapshot")
+		if !ok {
+			return
+		}
+		sn, _ := strconv.ParseUint(string(res.Body), 10, 32)
+		writeJSON(w, http.StatusOK, map[string]uint64{"snapshot": sn})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "must be a GET or POST")
+	}
+}
+
+// list reads a page of items from snapshot, keys from start up to end.
+// With a snapshot opened by number every page of a listing sees the same
+// items
+func (s *luxStor) list(snap *memstore.Snapshot, start, end []byte, limit int) kvList {
+	list := kvList{Items: []kvItem{}}
+	from := start
+	for {
+		items, next := s.scanSnapshot(snap, from, limit)
+		for _, bItem := range items {
+			if len(end) > 0 && bytes.Compare(bItem.Key(), end) >= 0 {
+				return list
+			}
+			if len(list.Items) == limit {
+				list.setNext(bItem.Key())
+				return list
+			}
+			list.Items = append(list.Items, newKVItem(bItem.Key(), bItem.Value(), bItem.Expiry()))
+		}
+		if next == nil {
+			return list
+		}
+		if len(list.Items) == limit {
+			if len(end) == 0 || bytes.Compare(next, end) < 0 {
+				list.setNext(next)
+			}
+			return list
+		}
+		from = next
+	}
+}
+
+// Snapshot handles DELETE /snapshots/<n>, which closes the snapshot, and
+// POST /snapshots/<n>/rollback
+func (hs *httpServer) Snapshot(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/snapshots/"), "/")
+	sn, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || len(parts) > 2 || len(parts) == 2 && parts[1] != "rollback" {
+		writeError(w, http.StatusNotFound, "no such endpoint")
+		return
+	}
+
+	if len(parts) == 1 {
+		if req.Method != "DELETE" {
+			writeError(w, http.StatusMethodNotAllowed, "must be a DELETE")
+			return
+		}
+		if _, ok := hs.admin(w, req, fmt.Sprintf("close-snapshot %d", sn)); ok {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if req.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "must be a POST")
+		return
+	}
+	if _, ok := hs.admin(w, req, fmt.Sprintf("rollback-snapshot %d", sn)); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"snapshot": sn})
+}
+
+// Stats returns the stats of the bucket, or those of ?group=, as an
+// object, numbers as numbers
+func (hs *httpServer) Stats(w http.ResponseWriter, req *http.Request) {
+	rh := hs.handler(w, req)
+	if rh == nil {
+		return
+	}
+	res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GAT, Key: []byte(req.FormValue("group"))})
+	if res.Status == gomemcached.KEY_ENOENT {
+		writeError(w, http.StatusNotFound, string(res.Body))
+		return
+	} else if res.Status != gomemcached.SUCCESS {
+		writeFailure(w, res, rh)
+		return
+	}
+
+	stats := make(map[string]interface{})
+	for _, stat := range strings.Split(string(res.Body), "\n") {
+		i := strings.LastIndex(stat, " ")
+		if i < 0 {
+			continue
+		}
+		name, value := stat[:i], stat[i+1:]
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			stats[name] = n
+		} else {
+			stats[name] = value
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
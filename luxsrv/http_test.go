@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func httpCall(t *testing.T, h http.HandlerFunc, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return w
+}
+
+// list every page from start, following next
+func listPages(t *testing.T, hs *httpServer, query string) (keys []string, pages []int) {
+	start := "&start="
+	for {
+		w := httpCall(t, hs.List, "GET", "/kv?"+query+start, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("list failed: %d %s", w.Code, w.Body.String())
+		}
+		var list kvList
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("bad listing %q: %v", w.Body.String(), err)
+		}
+		for _, item := range list.Items {
+			keys = append(keys, item.Key+"="+item.Value)
+		}
+		pages = append(pages, len(list.Items))
+		if list.Next == "" {
+			return
+		}
+		start = "&start=" + url.QueryEscape(list.Next)
+		if list.NextBase64 {
+			start += "&base64=true"
+		}
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	setupBucket(t)
+	hs := &httpServer{}
+	for i := 0; i < 25; i++ {
+		if w := httpCall(t, hs.KV, "PUT", fmt.Sprintf("/kv/k%02d", i), fmt.Sprint(i)); w.Code != http.StatusNoContent {
+			t.Fatalf("put failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	httpCall(t, hs.KV, "DELETE", "/kv/k03", "")
+
+	keys, pages := listPages(t, hs, "limit=10")
+	if fmt.Sprint(pages) != "[10 10 4]" || len(keys) != 24 || keys[0] != "k00=0" || keys[3] != "k04=4" || keys[23] != "k24=24" {
+		t.Errorf("listed pages %v of %v", pages, keys)
+	}
+
+	// a listing ending on a page boundary has no next
+	keys, pages = listPages(t, hs, "limit=5&end=k06")
+	if fmt.Sprint(pages) != "[5]" || keys[4] != "k05=5" {
+		t.Errorf("listed pages %v of %v up to k06", pages, keys)
+	}
+
+	// pages of a snapshot all see the items as they were
+	w := httpCall(t, hs.Snapshots, "POST", "/snapshots", "")
+	var snap struct{ Snapshot int }
+	json.Unmarshal(w.Body.Bytes(), &snap)
+	httpCall(t, hs.KV, "PUT", "/kv/k20", "changed")
+	httpCall(t, hs.KV, "DELETE", "/kv/k21", "")
+	keys, pages = listPages(t, hs, fmt.Sprintf("limit=10&snapshot=%d", snap.Snapshot))
+	if fmt.Sprint(pages) != "[10 10 4]" || keys[19] != "k20=20" || keys[20] != "k21=21" {
+		t.Errorf("listed snapshot pages %v of %v", pages, keys)
+	}
+	keys, _ = listPages(t, hs, "limit=100")
+	if len(keys) != 23 || keys[19] != "k20=changed" {
+		t.Errorf("listed %v after the snapshot", keys)
+	}
+
+	if w := httpCall(t, hs.List, "GET", "/kv?limit=0", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("limit 0 accepted: %d", w.Code)
+	}
+}
+
+// a page starting on a key that is not utf-8 carries on from that key
+func TestListBinaryNext(t *testing.T) {
+	setupBucket(t)
+	hs := &httpServer{}
+	asciiSession("set \xff1 0 0 1\r\na\r\nset \xff2 0 0 1\r\nb\r\nset \xff3 0 0 1\r\nc\r\n")
+
+	w := httpCall(t, hs.List, "GET", "/kv?limit=1", "")
+	var list kvList
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if !list.NextBase64 || list.Next != base64.StdEncoding.EncodeToString([]byte("\xff2")) {
+		t.Errorf("next %q, base64 %v", list.Next, list.NextBase64)
+	}
+	keys, pages := listPages(t, hs, "limit=1")
+	if fmt.Sprint(pages) != "[1 1 1]" || len(keys) != 3 || keys[2] != base64.StdEncoding.EncodeToString([]byte("\xff3"))+"=Yw==" {
+		t.Errorf("listed pages %v of %v", pages, keys)
+	}
+
+	if w := httpCall(t, hs.List, "GET", "/kv?start=%ff&base64=true", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("bad base64 accepted: %d", w.Code)
+	}
+}
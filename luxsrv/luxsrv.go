@@ -5,66 +5,138 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net"
+	"runtime"
+	"time"
 
 	"github.com/couchbase/gomemcached"
 	"github.com/couchbase/gomemcached/server"
+	"github.com/maniktaneja/luxstor/auth"
+	"github.com/maniktaneja/luxstor/clusterclient"
 	"github.com/maniktaneja/luxstor/replica"
 )
 
 var port = flag.Int("port", 11212, "Port on which to listen")
-var clusterMgr = flag.String("clusterMgr", "http://localhost:8091/", "Cluster manager url")
-
-type chanReq struct {
-	req *gomemcached.MCRequest
-	res chan *gomemcached.MCResponse
-}
+var nodeID = flag.String("nodeId", "", "Id (host:port) of this node in the cluster, defaults to localhost:port")
+var clusterMgr = flag.String("clusterMgr", "http://localhost:8091/", "Cluster manager urls, comma separated")
+var repQueueSize = flag.Int("repQueueSize", 100000, "Size of the replication queue of each remote host")
+var repQueuePolicy = flag.String("repQueuePolicy", "block", "What to do when a replication queue is full: block, fail or drop")
+var repRetries = flag.Int("repRetries", 5, "Number of times a failed replication write is retried")
+var repWorkers = flag.Int("repWorkers", 4, "Number of replication workers per remote host")
+var proxyAsync = flag.Bool("proxyAsync", false, "Acknowledge proxied writes before the owner has applied them")
+var proxy = flag.Bool("proxy", true, "Proxy requests for keys owned by other nodes instead of replying NOT_MY_VBUCKET")
+var proxyTimeout = flag.Duration("proxyTimeout", 5*time.Second, "Timeout for requests proxied to the owner of a key")
+var nodePassword = flag.String("nodePassword", "", "Password the nodes and managers of the cluster log in to each other with")
+var requireAuth = flag.Bool("requireAuth", false, "Require clients to log in even before the cluster has users")
+var tlsCert = flag.String("tlsCert", "", "Certificate (PEM) of this node, enables TLS on -port")
+var tlsKey = flag.String("tlsKey", "", "Key (PEM) of the -tlsCert certificate")
+var tlsCA = flag.String("tlsCA", "", "CA (PEM) the certificates of the cluster are signed by")
+var tlsNodes = flag.Bool("tlsNodes", false, "Connect to other nodes with mutual TLS")
+var requireTLS = flag.Bool("requireTLS", false, "Refuse plain connections")
+var asciiPort = flag.Int("asciiPort", 0, "Port on which to listen for the text protocol, 0 to disable")
+var respPort = flag.Int("respPort", 0, "Port on which to listen for the redis protocol, 0 to disable")
+var httpPort = flag.Int("httpPort", 0, "Port of the REST api, 0 to disable")
+var concurrency = flag.Int("concurrency", 4*runtime.NumCPU(), "Number of requests handled at the same time")
+var drainTimeout = flag.Duration("drainTimeout", 30*time.Second, "Time allowed on shutdown to finish requests and send queued replication writes")
+var shutdownSnapshot = flag.String("shutdownSnapshot", "", "Directory each bucket's items are written to on shutdown, none if empty")
+var maxConns = flag.Int("maxConns", 10000, "Most client connections open at once over all protocols, 0 for no limit")
+var idleTimeout = flag.Duration("idleTimeout", 0, "Close connections that send no request for this long, 0 to keep them")
+var readTimeout = flag.Duration("readTimeout", 30*time.Second, "Time allowed to read the rest of a request once it has started, 0 for no limit")
 
+// one handler per connection, holding the bucket it selected and the
+// user it logged in as
 type reqHandler struct {
-	ch chan chanReq
+	bucket string
+	user   string
+	scram  *auth.Scram // SCRAM exchange in progress
+	conn   *clientConn // nil for http requests
 }
 
 func (rh *reqHandler) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
-	cr := chanReq{
-		req,
-		make(chan *gomemcached.MCResponse, 1),
+	start := time.Now()
+	res := rh.handleMessage(req)
+	observeRequest(req.Opcode, res, time.Since(start))
+	if rh.conn != nil {
+		rh.conn.requestDone()
 	}
+	return res
+}
 
-	rh.ch <- cr
-	return <-cr.res
+func (rh *reqHandler) handleMessage(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.SASL_LIST_MECHS, gomemcached.SASL_AUTH, gomemcached.SASL_STEP:
+		return handleSasl(req, rh)
+	case gomemcached.SELECT_BUCKET:
+		return handleSelectBucket(req, rh)
+	}
+	if res := rh.authorize(req); res != nil {
+		return res
+	}
+	return rh.run(req)
 }
 
-func connectionHandler(s net.Conn, h memcached.RequestHandler) {
+func connectionHandler(c *clientConn) {
+	conn, err := startConn(c)
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Dropping connection from %v: %v", c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+
+	h := &reqHandler{bucket: client.DefaultBucket, conn: c}
 	// Explicitly ignoring errors since they all result in the
 	// client getting hung up on and many are common.
-	_ = memcached.HandleIO(s, h)
+	_ = memcached.HandleIO(conn, h)
 }
 
-func waitForConnections(ls net.Listener) {
-	reqChannel := make(chan chanReq, 100000)
-
-	go RunServer(reqChannel)
-	handler := &reqHandler{reqChannel}
-
+func waitForConnections(ls *clientListener) {
 	log.Printf("Listening on port %d", *port)
-	for {
-		s, e := ls.Accept()
-		if e == nil {
-			//log.Printf("Got a connection from %v", s.RemoteAddr())
-			go connectionHandler(s, handler)
-		} else {
-			log.Printf("Error accepting from %s", ls)
-		}
-	}
+	acceptLoop(ls, connectionHandler)
 }
 
 func main() {
 	flag.Parse()
-	replica.Init(*clusterMgr)
-	ls, e := net.Listen("tcp", fmt.Sprintf(":%d", *port))
-	if e != nil {
-		log.Fatalf("Got an error:  %s", e)
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	if *concurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1")
+	}
+	initSlots(*concurrency)
+
+	policy, err := replica.ParseQueuePolicy(*repQueuePolicy)
+	if err != nil {
+		log.Fatalf("Invalid replication queue policy: %v", err)
+	}
+	replica.QueueSize = *repQueueSize
+	replica.QueueFullPolicy = policy
+	replica.QueueMaxRetries = *repRetries
+	replica.QueueWorkers = *repWorkers
+	replica.ProxyAsync = *proxyAsync
+	replica.ProxyTimeout = *proxyTimeout
+	replica.ProxyRequests = *proxy
+	replica.NodePassword = *nodePassword
+	client.NodePassword = *nodePassword
+	initAuth(*nodePassword)
+	initTLS()
+
+	if *nodeID == "" {
+		*nodeID = fmt.Sprintf("localhost:%d", *port)
+	}
+	replica.Init(*clusterMgr, *nodeID)
+	syncBuckets()
+	go watchBuckets()
+
+	ls := listen(*port, "binary")
+	if *asciiPort != 0 {
+		go waitForAsciiConnections(listen(*asciiPort, "text"))
+	}
+	if *respPort != 0 {
+		go waitForRespConnections(listen(*respPort, "redis"))
+	}
+	if *httpPort != 0 {
+		go serveHTTP(listen(*httpPort, "http"))
 	}
+	go waitForConnections(ls)
 
-	waitForConnections(ls)
+	waitForShutdown()
 }
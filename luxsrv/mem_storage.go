@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"github.com/couchbase/gomemcached"
 	"github.com/maniktaneja/luxstor/memstore"
 	"github.com/maniktaneja/luxstor/replica"
-	"github.com/scryner/lfreequeue"
+	"hash/fnv"
 	"log"
-	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type storage struct {
@@ -16,23 +21,46 @@ type storage struct {
 	cas  uint64
 }
 
+const version = "luxstor"
+
 type handler func(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse
 
 var handlers = map[gomemcached.CommandCode]handler{
-	gomemcached.SET:           handleSet,
-	gomemcached.GET:           handleGet,
-	gomemcached.DELETE:        handleDelete,
-	gomemcached.FLUSH:         handleFlush,
-	gomemcached.GAT:           handleStat,
-	gomemcached.SELECT_BUCKET: handleSnapshot,
+	gomemcached.SET:         handleSet,
+	gomemcached.SETQ:        handleSetQuiet,
+	gomemcached.ADD:         handleSet,
+	gomemcached.REPLACE:     handleSet,
+	gomemcached.INCREMENT:   handleArith,
+	gomemcached.DECREMENT:   handleArith,
+	gomemcached.NOOP:        handleNoop,
+	gomemcached.VERSION:     handleVersion,
+	gomemcached.GET:         handleGet,
+	gomemcached.DELETE:      handleDelete,
+	gomemcached.DELETEQ:     handleDeleteQuiet,
+	gomemcached.FLUSH:       handleFlush,
+	gomemcached.GAT:         handleStat,
+	gomemcached.SET_VBUCKET: handleAdmin,
 }
 
 type luxStor struct {
-	memdb     *memstore.MemStore
-	workQueue *lfreequeue.Queue
-	writers   []*memstore.Writer
+	name     string
+	memdb    *memstore.MemStore
+	cas      uint64
+	quota    uint64 // bytes, 0 for no limit
+	used     uint64
+	writers  []*memstore.Writer
+	keyLocks [keyLockCount]sync.Mutex
+
+	// snapshots created with create-snapshot, by number. Each is closed
+	// once, by close-snapshot, whatever else holds it open
+	snapsLock sync.Mutex
+	snaps     map[string]*memstore.Snapshot
 }
 
+// writes to a key are serialized on one of these locks, so commands that
+// read the value before writing it, like add or incr, see a stable value
+const keyLockCount = 256
+
 type luxStats struct {
 	Gets uint64
 	Sets uint64
@@ -41,62 +69,166 @@ type luxStats struct {
 var luxstats luxStats
 
 // init memdb
-func initMemdb() *luxStor {
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
+func initMemdb(name string) *luxStor {
 
-	ls := &luxStor{memdb: memstore.New()}
+	ls := &luxStor{name: name, memdb: memstore.New(), snaps: make(map[string]*memstore.Snapshot)}
 	ls.memdb.SetKeyComparator(byteItemKeyCompare)
-	ls.workQueue = lfreequeue.NewQueue()
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+	// a writer per slot
+	for i := 0; i < cap(slots); i++ {
 		ls.writers = append(ls.writers, ls.memdb.NewWriter())
 	}
 
-	// create a queue of writers
-	for i := 0; i < 128; i++ {
-		w := ls.memdb.NewWriter()
-		ls.workQueue.Enqueue(w)
+	return ls
+}
+
+func (s *luxStor) lockKey(key []byte) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(key)
+	l := &s.keyLocks[h.Sum32()%keyLockCount]
+	l.Lock()
+	return l
+}
+
+// lookup returns the current item of key, expired or not
+func (s *luxStor) lookup(w *memstore.Writer, key []byte) (byteItem, bool) {
+	itm := w.Get(memstore.NewItem(newByteItem(key, nil, 0, 0)))
+	if itm == nil {
+		return nil, false
 	}
+	return byteItem(itm.Bytes()), true
+}
 
-	return ls
+// replacedSize returns the room the current version of key takes in the
+// quota, 0 if there is none
+func (s *luxStor) replacedSize(w *memstore.Writer, key []byte) uint64 {
+	if old, ok := s.lookup(w, key); ok {
+		return itemSize(key, old.Value())
+	}
+	return 0
 }
 
-func worker(id int, jobs <-chan *job) {
-	for j := range jobs {
-		//log.Printf("Worker id %d", id)
-		j.res <- dispatch(j.req, j.s, id)
+// get returns the current value of key, expired items are left out
+func (s *luxStor) get(w *memstore.Writer, key []byte) ([]byte, bool) {
+	bItem, ok := s.lookup(w, key)
+	if !ok || bItem.Expired() {
+		return nil, false
 	}
+	return bItem.Value(), true
 }
 
-type job struct {
-	req *gomemcached.MCRequest
-	res chan *gomemcached.MCResponse
-	s   *luxStor
+// put stores value under key. The current version is marked dead first,
+// inserting next to it would leave two versions of the key born in the
+// same snapshot and a read could return either
+func (s *luxStor) put(w *memstore.Writer, key, value []byte, exp uint32) (cas uint64) {
+	s.del(w, key)
+	cas = atomic.AddUint64(&s.cas, 1)
+	w.Put(memstore.NewItem(newByteItem(key, value, exp, cas)))
+	return
 }
 
-// RunServer runs the cache server.
-func RunServer(input chan chanReq) {
-	var s *luxStor
-	//s.data = make(map[string]gomemcached.MCItem)
-	s = initMemdb()
+// del removes key, returns false if there was no such key or it had
+// expired
+func (s *luxStor) del(w *memstore.Writer, key []byte) bool {
+	old, ok := s.lookup(w, key)
+	if !ok {
+		return false
+	}
+	w.Delete(memstore.NewItem(newByteItem(key, nil, 0, 0)))
+	s.release(key, old.Value())
+	return !old.Expired()
+}
 
-	jobQueue := make(chan *job, 500000)
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go worker(i, jobQueue)
+// reap deletes an expired key on its owner and its replicas
+func (s *luxStor) reap(w *memstore.Writer, req *gomemcached.MCRequest) {
+	l := s.lockKey(req.Key)
+	defer l.Unlock()
+
+	bItem, ok := s.lookup(w, req.Key)
+	if !ok || !bItem.Expired() {
+		return
+	}
+	del := &gomemcached.MCRequest{Opcode: gomemcached.DELETE, VBucket: req.VBucket, Key: req.Key}
+	if err := replica.QueueRemoteWrite(s.name, del); err != nil {
+		return
 	}
+	s.del(w, req.Key)
+}
 
-	for {
+// scan returns the keys of this node's vbuckets in order from start on,
+// looking at up to n keys. next is the key to carry on from, nil once the
+// end is reached. Keys owned by other nodes and expired ones are skipped
+// but count towards n
+func (s *luxStor) scan(start []byte, n int) (keys [][]byte, next []byte) {
+	snap := s.memdb.NewSnapshot()
+	defer snap.Close()
+	items, next := s.scanSnapshot(snap, start, n)
+	for _, bItem := range items {
+		keys = append(keys, bItem.Key())
+	}
+	return keys, next
+}
+
+// scanSnapshot is scan reading the items of an open snapshot
+func (s *luxStor) scanSnapshot(snap *memstore.Snapshot, start []byte, n int) (items []byteItem, next []byte) {
+	itr := snap.NewIterator()
+	if itr == nil {
+		// closed meanwhile
+		return nil, nil
+	}
+	defer itr.Close()
+
+	var prev []byte
+	for itr.Seek(memstore.NewItem(newByteItem(start, nil, 0, 0))); itr.Valid(); itr.Next() {
+		bItem := byteItem(itr.Get().Bytes())
+		key := bItem.Key()
+		if prev != nil && bytes.Equal(prev, key) {
+			continue
+		}
+		if n == 0 {
+			return items, key
+		}
+		n--
+		prev = key
+		if bItem.Expired() || !replica.IsOwner(s.name, &gomemcached.MCRequest{Key: key}) {
+			continue
+		}
+		items = append(items, bItem)
+	}
+	return items, nil
+}
+
+// Requests run on the goroutine of their connection, so a connection's
+// requests are handled in order without a hop through another goroutine.
+// At most len(slots) run at once, each holding a slot and with it the
+// writer of that slot in every bucket
+var slots chan int
 
-		j := &job{}
-		req := <-input
-		//log.Printf("Got a request: %s", req.req)
-		j.req = req.req
-		j.res = req.res
-		j.s = s
-		jobQueue <- j
+func initSlots(n int) {
+	slots = make(chan int, n)
+	for i := 0; i < n; i++ {
+		slots <- i
 	}
 }
 
+// run handles a request in the connection's bucket
+func (rh *reqHandler) run(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	s := getBucket(rh.bucket)
+	if s == nil {
+		// the bucket was deleted
+		return &gomemcached.MCResponse{Status: gomemcached.NO_BUCKET}
+	}
+
+	// vbucket moves can take minutes and don't need a writer, so they
+	// must not hold up a slot
+	if req.Opcode == gomemcached.SET_VBUCKET {
+		return dispatch(req, s, -1)
+	}
+
+	id := <-slots
+	defer func() { slots <- id }()
+	return dispatch(req, s, id)
+}
+
 func dispatch(req *gomemcached.MCRequest, s *luxStor, id int) (rv *gomemcached.MCResponse) {
 	if h, ok := handlers[req.Opcode]; ok {
 		rv = h(req, s, id)
@@ -112,42 +244,107 @@ func notFound(req *gomemcached.MCRequest, s *luxStor) *gomemcached.MCResponse {
 	return &response
 }
 
+// expiration of a set in unix seconds. The extras of a set that is
+// replicated are rewritten to hold it, so the replicas expire the item
+// at the same time whenever the write reaches them
+func writeExpiry(req *gomemcached.MCRequest) uint32 {
+	if len(req.Extras) < 8 {
+		return 0
+	}
+	exp := absExpiry(binary.BigEndian.Uint32(req.Extras[4:]))
+	if exp != 0 {
+		extras := make([]byte, len(req.Extras))
+		copy(extras, req.Extras)
+		binary.BigEndian.PutUint32(extras[4:], exp)
+		req.Extras = extras
+	}
+	return exp
+}
+
+// set, add and replace differ only in whether the key may or must exist
 func handleSet(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
 
-	/*
-		item.Flags = binary.BigEndian.Uint32(req.Extras)
-		item.Expiration = binary.BigEndian.Uint32(req.Extras[4:])
-		item.Data = req.Body
-		ret.Status = gomemcached.SUCCESS
-		s.cas++
-		item.Cas = s.cas
-		ret.Cas = s.cas
-	*/
-
-	flags := binary.BigEndian.Uint32(req.Extras)
-	// flags == 0 is a normal write and must be replicated
-	if flags == 0 {
-		if replica.IsOwner(req) != true {
-			// nothing more to be done
-			replica.ProxyRemoteWrite(req)
-			return
-		} else {
-			replica.QueueRemoteWrite(req)
+	flags := replica.WriteFlags(req)
+	// a write from a client or proxied by another node must be replicated
+	replicated := flags&replica.WriteReplicated != 0
+	if !replicated {
+		if replica.IsOwner(s.name, req) != true {
+			if !replica.ProxyRequests || flags&replica.WriteProxied != 0 {
+				// the sender's map is stale, don't bounce the write around
+				return replica.NotMyVbucket(s.name)
+			}
+			// the owner's response goes back to the client
+			return replica.ProxyRemoteWrite(s.name, req)
 		}
 	}
 
-	data := newByteItem(req.Key, req.Body)
-	itm := memstore.NewItem(data)
+	exp := writeExpiry(req)
 
+	l := s.lockKey(req.Key)
+	defer l.Unlock()
 	w := s.writers[id]
-	w.Put(itm)
 
-	luxstats.Sets++
+	switch req.Opcode {
+	case gomemcached.ADD:
+		if _, ok := s.get(w, req.Key); ok {
+			ret.Status = gomemcached.KEY_EEXISTS
+			return
+		}
+	case gomemcached.REPLACE:
+		if _, ok := s.get(w, req.Key); !ok {
+			ret.Status = gomemcached.KEY_ENOENT
+			return
+		}
+	}
+
+	if !s.reserve(req.Key, req.Body, s.replacedSize(w, req.Key)) {
+		ret.Status = gomemcached.ENOMEM
+		return
+	}
+
+	if !replicated {
+		if err := replica.QueueRemoteWrite(s.name, req); err != nil {
+			s.release(req.Key, req.Body)
+			ret.Status = gomemcached.TMPFAIL
+			return
+		}
+	}
+
+	ret.Cas = s.put(w, req.Key, req.Body, exp)
+
+	atomic.AddUint64(&luxstats.Sets, 1)
 
 	return
 }
 
+// quiet sets only get a response when they fail
+func handleSetQuiet(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse {
+	ret := handleSet(req, s, id)
+	if ret.Status == gomemcached.SUCCESS {
+		return nil
+	}
+	return ret
+}
+
+func handleNoop(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{Status: gomemcached.SUCCESS}
+}
+
+// other nodes check for "luxstor" before sending deletes with write flags
+func handleVersion(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{Body: []byte(version)}
+}
+
+// admin commands, sent as the key of a SET_VBUCKET. They apply to the
+// bucket selected on the connection
+func handleAdmin(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse {
+	if strings.HasPrefix(string(req.Key), "vb-move") {
+		return handleVbucketMove(req, s, id)
+	}
+	return handleSnapshot(req, s, id)
+}
+
 func handleSnapshot(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
 
@@ -158,61 +355,296 @@ func handleSnapshot(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemc
 	if string(req.Key) == "create-snapshot" {
 		snap := s.memdb.NewSnapshot()
 		fmt.Println("Created snapshot", snap)
+		s.snapsLock.Lock()
+		s.snaps[snap.String()] = snap
+		s.snapsLock.Unlock()
 		ret.Body = []byte(snap.String())
+	} else if string(req.Key) == "list-snapshots" {
+		// one "snapshot items" line per snapshot, oldest first
+		s.snapsLock.Lock()
+		snaps := make([]*memstore.Snapshot, 0, len(s.snaps))
+		for _, snap := range s.snaps {
+			snaps = append(snaps, snap)
+		}
+		s.snapsLock.Unlock()
+		sort.Slice(snaps, func(i, j int) bool { return snapNumber(snaps[i]) < snapNumber(snaps[j]) })
+
+		var lines []string
+		for _, snap := range snaps {
+			lines = append(lines, fmt.Sprintf("%s %d", snap, snap.Count()))
+		}
+		ret.Body = []byte(strings.Join(lines, "\n"))
+	} else if n, err := fmt.Sscanf(string(req.Key), "close-snapshot %d", &sn); err == nil && n == 1 {
+		s.snapsLock.Lock()
+		snap := s.snaps[fmt.Sprint(sn)]
+		delete(s.snaps, fmt.Sprint(sn))
+		s.snapsLock.Unlock()
+		if snap == nil {
+			ret.Status = gomemcached.KEY_ENOENT
+			ret.Body = []byte("no such snapshot")
+			return
+		}
+		log.Printf("Closing snapshot %v of bucket %s", snap, s.name)
+		// listings still reading it hold their own reference
+		snap.Close()
 	} else if n, err := fmt.Sscanf(string(req.Key), "rollback-snapshot %d", &sn); err == nil && n == 1 {
+		if snap := s.openSnapshot(sn); snap != nil {
+			snap.Close()
+		} else {
+			ret.Status = gomemcached.KEY_ENOENT
+			ret.Body = []byte("no such snapshot")
+			return
+		}
 		snap := memstore.SnapshotFromSn(sn)
 		fmt.Println("Rollback to snapshot", snap)
 		s.memdb.Rollback(snap)
+	} else {
+		ret.Status = gomemcached.EINVAL
 	}
 	return
 }
 
+// openSnapshot takes a reference on snapshot sn, which must have been
+// created with create-snapshot and not closed, nil if there is none.
+// Close it when done. Rolling back is only allowed to such a snapshot
+func (s *luxStor) openSnapshot(sn uint32) *memstore.Snapshot {
+	s.snapsLock.Lock()
+	defer s.snapsLock.Unlock()
+	snap := s.snaps[fmt.Sprint(sn)]
+	if snap == nil || !snap.Open() {
+		return nil
+	}
+	return snap
+}
+
+func snapNumber(snap *memstore.Snapshot) uint64 {
+	n, _ := strconv.ParseUint(snap.String(), 10, 32)
+	return n
+}
+
 func handleGet(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
 
-	if replica.IsOwner(req) != true {
-		return replica.ProxyRemoteRead(req)
+	replicaRead := replica.ReadFlags(req)&replica.ReadReplicaOK != 0 && replica.IsReplica(s.name, req)
+	if replica.IsOwner(s.name, req) != true && !replicaRead {
+		if !replica.ProxyRequests || replica.ReadFlags(req)&replica.ReadProxied != 0 {
+			// the sender's map is stale, don't bounce the read around
+			return replica.NotMyVbucket(s.name)
+		}
+		return replica.ProxyRemoteRead(s.name, req)
 	}
 
-	data := newByteItem(req.Key, nil)
-	itm := memstore.NewItem(data)
 	w := s.writers[id]
-	gotItm := w.Get(itm)
-	if gotItm == nil {
-		ret.Status = gomemcached.KEY_ENOENT
-	} else {
-		bItem := byteItem(gotItm.Bytes())
+	if bItem, ok := s.lookup(w, req.Key); ok && !bItem.Expired() {
 		ret.Body = bItem.Value()
+		ret.Cas = bItem.Cas()
 		ret.Status = gomemcached.SUCCESS
+	} else {
+		if ok && !replicaRead {
+			s.reap(w, req)
+		}
+		ret.Status = gomemcached.KEY_ENOENT
 	}
 
-	luxstats.Gets++
+	atomic.AddUint64(&luxstats.Gets, 1)
 
 	return
 }
 
+// stats are returned one per line as "name value"
 func handleStat(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
 
-	stats := fmt.Sprintf("Sets: %d, Gets %d", luxstats.Sets, luxstats.Gets)
-	ret.Body = []byte(stats)
+	// the key names a group of stats other than the default ones
+	switch string(req.Key) {
+	case "":
+	case "connections":
+		ret.Body = []byte(strings.Join(connectionStats(), "\n"))
+		return
+	default:
+		ret.Status = gomemcached.KEY_ENOENT
+		ret.Body = []byte("no such stats group")
+		return
+	}
+
+	stats := []string{
+		fmt.Sprintf("sets %d", atomic.LoadUint64(&luxstats.Sets)),
+		fmt.Sprintf("gets %d", atomic.LoadUint64(&luxstats.Gets)),
+		fmt.Sprintf("bucket %s", s.name),
+		fmt.Sprintf("curr_items %d", s.memdb.ItemsCount()),
+		fmt.Sprintf("bucket_used %d", atomic.LoadUint64(&s.used)),
+		fmt.Sprintf("bucket_quota %d", atomic.LoadUint64(&s.quota)),
+	}
+	for host, hs := range replica.QueueStats() {
+		stats = append(stats,
+			fmt.Sprintf("rep_queued:%s %d", host, hs.Queued),
+			fmt.Sprintf("rep_sent:%s %d", host, hs.Sent),
+			fmt.Sprintf("rep_retried:%s %d", host, hs.Retried),
+			fmt.Sprintf("rep_dropped:%s %d", host, hs.Dropped),
+			fmt.Sprintf("rep_superseded:%s %d", host, hs.Superseded),
+			fmt.Sprintf("rep_rejected:%s %d", host, hs.Rejected),
+			fmt.Sprintf("rep_depth:%s %d", host, hs.Depth))
+	}
+	ret.Body = []byte(strings.Join(stats, "\n"))
 	ret.Status = gomemcached.SUCCESS
 
 	return
 }
 
+// flush drops every item of the bucket on this node. It is not sent to
+// the replicas or the other nodes
 func handleFlush(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
-	delay := binary.BigEndian.Uint32(req.Extras)
-	if delay > 0 {
-		log.Printf("Delay not supported (got %d)", delay)
+	if len(req.Extras) >= 4 {
+		if delay := binary.BigEndian.Uint32(req.Extras); delay > 0 {
+			log.Printf("Delay not supported (got %d)", delay)
+		}
+	}
+
+	snap := s.memdb.NewSnapshot()
+	itr := snap.NewIterator()
+	var keys [][]byte
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		bItem := byteItem(itr.Get().Bytes())
+		keys = append(keys, bItem.Key())
+	}
+	itr.Close()
+	snap.Close()
+
+	w := s.writers[id]
+	flushed := 0
+	for _, key := range keys {
+		l := s.lockKey(key)
+		if s.del(w, key) {
+			flushed++
+		}
+		l.Unlock()
 	}
-	//s.data = make(map[string]gomemcached.MCItem)
+	log.Printf("Flushed %d items of bucket %s", flushed, s.name)
 	return
 }
 
 func handleDelete(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
 	ret = &gomemcached.MCResponse{}
-	//delete(s.data, string(req.Key))
+
+	flags := replica.WriteFlags(req)
+	replicated := flags&replica.WriteReplicated != 0
+	if !replicated && !replica.IsOwner(s.name, req) {
+		if !replica.ProxyRequests || flags&replica.WriteProxied != 0 {
+			return replica.NotMyVbucket(s.name)
+		}
+		return replica.ProxyRemoteWrite(s.name, req)
+	}
+
+	l := s.lockKey(req.Key)
+	defer l.Unlock()
+	w := s.writers[id]
+
+	// a replicated delete of a key that isn't there has nothing to do
+	if _, ok := s.lookup(w, req.Key); !ok {
+		if !replicated {
+			ret.Status = gomemcached.KEY_ENOENT
+		}
+		return
+	}
+
+	if !replicated {
+		if err := replica.QueueRemoteWrite(s.name, req); err != nil {
+			ret.Status = gomemcached.TMPFAIL
+			return
+		}
+	}
+
+	// an expired key is deleted all the same, but didn't exist for the
+	// client
+	if !s.del(w, req.Key) && !replicated {
+		ret.Status = gomemcached.KEY_ENOENT
+	}
+	return
+}
+
+// quiet deletes only get a response when they fail
+func handleDeleteQuiet(req *gomemcached.MCRequest, s *luxStor, id int) *gomemcached.MCResponse {
+	ret := handleDelete(req, s, id)
+	if ret.Status == gomemcached.SUCCESS {
+		return nil
+	}
+	return ret
+}
+
+// incr and decr work on values that are decimal numbers. The extras hold
+// the delta, the initial value and the expiration, 0xffffffff meaning a
+// missing key is not created. decr stops at 0 and incr wraps around at
+// 2^64. The new value keeps the expiration of the old one and is
+// replicated as a set
+func handleArith(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
+	ret = &gomemcached.MCResponse{}
+	if len(req.Extras) < 20 {
+		ret.Status = gomemcached.EINVAL
+		return
+	}
+
+	if !replica.IsOwner(s.name, req) {
+		if !replica.ProxyRequests || replica.WriteFlags(req)&replica.WriteProxied != 0 {
+			return replica.NotMyVbucket(s.name)
+		}
+		return replica.ProxyRemoteWrite(s.name, req)
+	}
+
+	delta := binary.BigEndian.Uint64(req.Extras)
+	initial := binary.BigEndian.Uint64(req.Extras[8:])
+	exp := binary.BigEndian.Uint32(req.Extras[16:])
+
+	l := s.lockKey(req.Key)
+	defer l.Unlock()
+	w := s.writers[id]
+
+	var v uint64
+	if old, ok := s.lookup(w, req.Key); !ok || old.Expired() {
+		if exp == 0xffffffff {
+			ret.Status = gomemcached.KEY_ENOENT
+			return
+		}
+		v = initial
+		exp = absExpiry(exp)
+	} else {
+		exp = old.Expiry()
+		n, err := strconv.ParseUint(string(old.Value()), 10, 64)
+		if err != nil {
+			ret.Status = gomemcached.DELTA_BADVAL
+			return
+		}
+		switch {
+		case req.Opcode == gomemcached.INCREMENT:
+			v = n + delta
+		case delta > n:
+			v = 0
+		default:
+			v = n - delta
+		}
+	}
+
+	set := &gomemcached.MCRequest{
+		Opcode:  gomemcached.SET,
+		VBucket: req.VBucket,
+		Key:     req.Key,
+		Body:    []byte(strconv.FormatUint(v, 10)),
+		Extras:  make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(set.Extras[4:], exp)
+	if !s.reserve(set.Key, set.Body, s.replacedSize(w, set.Key)) {
+		ret.Status = gomemcached.ENOMEM
+		return
+	}
+	if err := replica.QueueRemoteWrite(s.name, set); err != nil {
+		s.release(set.Key, set.Body)
+		ret.Status = gomemcached.TMPFAIL
+		return
+	}
+	ret.Cas = s.put(w, set.Key, set.Body, exp)
+
+	ret.Body = make([]byte, 8)
+	binary.BigEndian.PutUint64(ret.Body, v)
+	atomic.AddUint64(&luxstats.Sets, 1)
 	return
 }
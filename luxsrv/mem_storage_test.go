@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+func admin(cmd string) *gomemcached.MCResponse {
+	rh := &reqHandler{bucket: client.DefaultBucket}
+	return rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.SET_VBUCKET, Key: []byte(cmd)})
+}
+
+// a snapshot is closed once however often it is deleted, listings reading
+// it keep their own reference
+func TestCloseSnapshot(t *testing.T) {
+	s := setupBucket(t)
+	asciiSession("set k 0 0 1\r\na\r\n")
+
+	res := admin("create-snapshot")
+	sn := string(res.Body)
+	var n uint32
+	fmt.Sscan(sn, &n)
+	asciiSession("set k 0 0 1\r\nb\r\n")
+
+	listing := s.openSnapshot(n)
+	if listing == nil {
+		t.Fatalf("snapshot %s not found", sn)
+	}
+	if res := admin("list-snapshots"); string(res.Body) != sn+" 1" {
+		t.Errorf("list-snapshots returned %q", res.Body)
+	}
+
+	if res := admin("close-snapshot " + sn); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("close failed: %v", res.Status)
+	}
+	for i := 0; i < 2; i++ {
+		if res := admin("close-snapshot " + sn); res.Status != gomemcached.KEY_ENOENT {
+			t.Errorf("closed snapshot closed again: %v", res.Status)
+		}
+	}
+	if s.openSnapshot(n) != nil {
+		t.Errorf("closed snapshot opened")
+	}
+
+	items, _ := s.scanSnapshot(listing, nil, 10)
+	if len(items) != 1 || string(items[0].Value()) != "a" {
+		t.Errorf("listing of the closed snapshot read %d items", len(items))
+	}
+	listing.Close()
+}
+
+// requests wait for a free slot, admin commands don't need one
+func TestSlots(t *testing.T) {
+	setupBucket(t)
+	held := []int{<-slots, <-slots}
+
+	done := make(chan *gomemcached.MCResponse)
+	go func() {
+		rh := &reqHandler{bucket: client.DefaultBucket}
+		done <- rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	}()
+	select {
+	case <-done:
+		t.Fatalf("request ran with every slot held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if res := admin("list-snapshots"); res.Status != gomemcached.SUCCESS {
+		t.Errorf("admin command failed with every slot held: %v", res.Status)
+	}
+
+	slots <- held[0]
+	select {
+	case res := <-done:
+		if res.Status != gomemcached.KEY_ENOENT {
+			t.Errorf("get returned %v", res.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("request still waiting after a slot was freed")
+	}
+	slots <- held[1]
+
+	// the slot is given back
+	if len(slots) != 2 {
+		t.Errorf("%d slots free after the request", len(slots))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/memstore"
+	"github.com/maniktaneja/luxstor/replica"
+)
+
+// /metrics on the http port, in the prometheus text format. Requests are
+// counted per opcode whatever protocol they came in with, their latency
+// includes the wait for a slot
+
+// upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// opcodes gomemcached has no name for
+var opNames = map[gomemcached.CommandCode]string{
+	gomemcached.SET_VBUCKET:   "SET_VBUCKET",
+	gomemcached.SELECT_BUCKET: "SELECT_BUCKET",
+}
+
+type opMetrics struct {
+	count   uint64
+	errors  uint64
+	nanos   uint64
+	buckets []uint64 // one per latency bucket, not cumulative
+}
+
+var opStats [256]opMetrics
+
+func init() {
+	for i := range opStats {
+		opStats[i].buckets = make([]uint64, len(latencyBuckets))
+	}
+}
+
+// a miss or a failed add is an answer, not an error
+func isError(res *gomemcached.MCResponse) bool {
+	if res == nil {
+		return false
+	}
+	switch res.Status {
+	case gomemcached.SUCCESS, gomemcached.KEY_ENOENT, gomemcached.KEY_EEXISTS, gomemcached.AUTH_CONTINUE:
+		return false
+	}
+	return true
+}
+
+func observeRequest(op gomemcached.CommandCode, res *gomemcached.MCResponse, d time.Duration) {
+	m := &opStats[uint8(op)]
+	atomic.AddUint64(&m.count, 1)
+	if isError(res) {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	atomic.AddUint64(&m.nanos, uint64(d))
+	secs := d.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			atomic.AddUint64(&m.buckets[i], 1)
+			break
+		}
+	}
+}
+
+// open and accepted connections of each protocol
+type connMetrics struct {
+	open  int64
+	total uint64
+}
+
+var connProtocols = []string{"binary", "text", "redis", "http"}
+
+var connStats = map[string]*connMetrics{
+	"binary": {},
+	"text":   {},
+	"redis":  {},
+	"http":   {},
+}
+
+// httpConnState counts the requests of http connections
+func httpConnState(conn net.Conn, state http.ConnState) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if c, ok := conn.(*clientConn); ok && state == http.StateActive {
+		c.requestDone()
+	}
+}
+
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+// family writes the HELP and TYPE lines of a metric
+func (w *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *metricsWriter) value(name string, labels []string, v interface{}) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			fmt.Fprintf(w, "%s=%q", labels[i], labels[i+1])
+		}
+		w.WriteString("}")
+	}
+	fmt.Fprintf(w, " %v\n", v)
+}
+
+// Metrics serves /metrics. Like health checks it needs no login
+func (hs *httpServer) Metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{Writer: bufio.NewWriter(w)}
+	defer mw.Flush()
+
+	writeRequestMetrics(mw)
+	writeBucketMetrics(mw)
+	writeReplicationMetrics(mw)
+
+	mw.family("luxsrv_connections", "gauge", "Open client connections.")
+	for _, p := range connProtocols {
+		mw.value("luxsrv_connections", []string{"protocol", p}, atomic.LoadInt64(&connStats[p].open))
+	}
+	mw.family("luxsrv_connections_total", "counter", "Client connections accepted.")
+	for _, p := range connProtocols {
+		mw.value("luxsrv_connections_total", []string{"protocol", p}, atomic.LoadUint64(&connStats[p].total))
+	}
+}
+
+func writeRequestMetrics(mw *metricsWriter) {
+	var ops []int
+	for i := range opStats {
+		if atomic.LoadUint64(&opStats[i].count) > 0 {
+			ops = append(ops, i)
+		}
+	}
+	opName := func(i int) string {
+		if name, ok := opNames[gomemcached.CommandCode(i)]; ok {
+			return name
+		}
+		return gomemcached.CommandCode(i).String()
+	}
+
+	mw.family("luxsrv_requests_total", "counter", "Requests handled, by opcode.")
+	for _, i := range ops {
+		mw.value("luxsrv_requests_total", []string{"opcode", opName(i)}, atomic.LoadUint64(&opStats[i].count))
+	}
+	mw.family("luxsrv_request_errors_total", "counter", "Requests that failed, misses and existing keys on add are not counted.")
+	for _, i := range ops {
+		mw.value("luxsrv_request_errors_total", []string{"opcode", opName(i)}, atomic.LoadUint64(&opStats[i].errors))
+	}
+
+	mw.family("luxsrv_request_duration_seconds", "histogram", "Time to answer a request, by opcode.")
+	for _, i := range ops {
+		m := &opStats[i]
+		var cum uint64
+		for b, le := range latencyBuckets {
+			cum += atomic.LoadUint64(&m.buckets[b])
+			mw.value("luxsrv_request_duration_seconds_bucket", []string{"opcode", opName(i), "le", fmt.Sprint(le)}, cum)
+		}
+		count := atomic.LoadUint64(&m.count)
+		mw.value("luxsrv_request_duration_seconds_bucket", []string{"opcode", opName(i), "le", "+Inf"}, count)
+		mw.value("luxsrv_request_duration_seconds_sum", []string{"opcode", opName(i)}, float64(atomic.LoadUint64(&m.nanos))/1e9)
+		mw.value("luxsrv_request_duration_seconds_count", []string{"opcode", opName(i)}, count)
+	}
+
+	mw.family("luxsrv_gets_total", "counter", "Gets served from this node's store.")
+	mw.value("luxsrv_gets_total", nil, atomic.LoadUint64(&luxstats.Gets))
+	mw.family("luxsrv_sets_total", "counter", "Writes applied to this node's store.")
+	mw.value("luxsrv_sets_total", nil, atomic.LoadUint64(&luxstats.Sets))
+}
+
+func writeBucketMetrics(mw *metricsWriter) {
+	bucketsLock.RLock()
+	stores := make(map[string]*luxStor, len(buckets))
+	var names []string
+	for name, s := range buckets {
+		stores[name] = s
+		names = append(names, name)
+	}
+	bucketsLock.RUnlock()
+	sort.Strings(names)
+
+	perBucket := func(name, typ, help string, f func(s *luxStor) interface{}) {
+		mw.family(name, typ, help)
+		for _, b := range names {
+			mw.value(name, []string{"bucket", b}, f(stores[b]))
+		}
+	}
+
+	perBucket("luxsrv_items", "gauge", "Items in the store, including replicas and not yet collected versions.",
+		func(s *luxStor) interface{} { return s.memdb.ItemsCount() })
+	perBucket("luxsrv_bucket_used_bytes", "gauge", "Bytes counted against the bucket's quota.",
+		func(s *luxStor) interface{} { return atomic.LoadUint64(&s.used) })
+	perBucket("luxsrv_bucket_quota_bytes", "gauge", "Quota of the bucket, 0 for none.",
+		func(s *luxStor) interface{} { return atomic.LoadUint64(&s.quota) })
+	perBucket("luxsrv_snapshots", "gauge", "Open snapshots.",
+		func(s *luxStor) interface{} { return len(s.memdb.GetSnapshots()) })
+	perBucket("luxsrv_memstore_gc_runs_total", "counter", "Garbage collections of dead items.",
+		func(s *luxStor) interface{} { runs, _ := s.memdb.GCStats(); return runs })
+	perBucket("luxsrv_memstore_dead_items_collected_total", "counter", "Dead items removed by garbage collection.",
+		func(s *luxStor) interface{} { _, dead := s.memdb.GCStats(); return dead })
+
+	stats := make(map[string]memstore.StatsReport, len(names))
+	for _, b := range names {
+		stats[b] = stores[b].memdb.GetStats()
+	}
+	perBucket("luxsrv_skiplist_read_conflicts_total", "counter", "Reads that had to retry past a node being changed.",
+		func(s *luxStor) interface{} { return stats[s.name].ReadConflicts })
+	perBucket("luxsrv_skiplist_insert_conflicts_total", "counter", "Inserts that lost a race and were retried.",
+		func(s *luxStor) interface{} { return stats[s.name].InsertConflicts })
+
+	mw.family("luxsrv_skiplist_nodes", "gauge", "Skiplist nodes by level.")
+	for _, b := range names {
+		for level, n := range stats[b].NodeDistribution {
+			if n != 0 {
+				mw.value("luxsrv_skiplist_nodes", []string{"bucket", b, "level", fmt.Sprint(level)}, n)
+			}
+		}
+	}
+}
+
+func writeReplicationMetrics(mw *metricsWriter) {
+	qs := replica.QueueStats()
+	var dests []string
+	for d := range qs {
+		dests = append(dests, d)
+	}
+	sort.Strings(dests)
+	labels := func(dest string) []string {
+		// host:port/bucket
+		i := strings.LastIndex(dest, "/")
+		return []string{"host", dest[:i], "bucket", dest[i+1:]}
+	}
+	for _, m := range []struct {
+		name, typ, help string
+		f               func(hs replica.HostStats) interface{}
+	}{
+		{"luxsrv_replication_queued_total", "counter", "Writes queued for another node.",
+			func(hs replica.HostStats) interface{} { return hs.Queued }},
+		{"luxsrv_replication_sent_total", "counter", "Queued writes applied by the other node.",
+			func(hs replica.HostStats) interface{} { return hs.Sent }},
+		{"luxsrv_replication_retried_total", "counter", "Writes sent again after a failure.",
+			func(hs replica.HostStats) interface{} { return hs.Retried }},
+		{"luxsrv_replication_dropped_total", "counter", "Writes given up on.",
+			func(hs replica.HostStats) interface{} { return hs.Dropped }},
+		{"luxsrv_replication_superseded_total", "counter", "Failed writes not retried as a later write to the key was sent.",
+			func(hs replica.HostStats) interface{} { return hs.Superseded }},
+		{"luxsrv_replication_rejected_total", "counter", "Client writes failed as the queue was full.",
+			func(hs replica.HostStats) interface{} { return hs.Rejected }},
+		{"luxsrv_replication_queue_depth", "gauge", "Writes waiting to be sent.",
+			func(hs replica.HostStats) interface{} { return hs.Depth }},
+	} {
+		mw.family(m.name, m.typ, m.help)
+		for _, d := range dests {
+			mw.value(m.name, labels(d), m.f(qs[d]))
+		}
+	}
+}
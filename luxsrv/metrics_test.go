@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+var (
+	metricsComment = regexp.MustCompile(`^# (HELP|TYPE) ([a-z_]+) (.+)$`)
+	metricsSample  = regexp.MustCompile(`^([a-z_]+)(\{([a-z]+="[^"]*",?)*\})? ([0-9.e+-]+)$`)
+)
+
+func TestMetrics(t *testing.T) {
+	setupBucket(t)
+	for i := range opStats {
+		opStats[i] = opMetrics{buckets: make([]uint64, len(latencyBuckets))}
+	}
+	ok := &gomemcached.MCResponse{}
+	for _, d := range []time.Duration{50 * time.Microsecond, 200 * time.Microsecond, 2 * time.Millisecond} {
+		observeRequest(gomemcached.GET, ok, d)
+	}
+	observeRequest(gomemcached.GET, &gomemcached.MCResponse{Status: gomemcached.TMPFAIL}, 10*time.Second)
+	observeRequest(gomemcached.SET, ok, time.Millisecond)
+
+	w := httpCall(t, (&httpServer{}).Metrics, "GET", "/metrics", "")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+
+	// every sample belongs to the family typed before it
+	types := make(map[string]string)
+	samples := make(map[string]string)
+	family := ""
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if m := metricsComment.FindStringSubmatch(line); m != nil {
+			family = m[2]
+			if m[1] == "TYPE" {
+				types[family] = m[3]
+			}
+			continue
+		}
+		m := metricsSample.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("bad line %q", line)
+			continue
+		}
+		name := m[1]
+		if types[family] == "histogram" {
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		}
+		if name != family {
+			t.Errorf("sample %q in family %s", line, family)
+		}
+		samples[m[1]+m[2]] = m[4]
+	}
+
+	want := map[string]string{
+		`luxsrv_requests_total{opcode="GET"}`:                               "4",
+		`luxsrv_requests_total{opcode="SET"}`:                               "1",
+		`luxsrv_request_errors_total{opcode="GET"}`:                         "1",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="0.0001"}`:  "1",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="0.00025"}`: "2",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="0.001"}`:   "2",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="0.0025"}`:  "3",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="5"}`:       "3",
+		`luxsrv_request_duration_seconds_bucket{opcode="GET",le="+Inf"}`:    "4",
+		`luxsrv_request_duration_seconds_count{opcode="GET"}`:               "4",
+		`luxsrv_items{bucket="default"}`:                                    "0",
+	}
+	for k, v := range want {
+		if samples[k] != v {
+			t.Errorf("%s is %q, want %s", k, samples[k], v)
+		}
+	}
+	if sum, _ := strconv.ParseFloat(samples[`luxsrv_request_duration_seconds_sum{opcode="GET"}`], 64); sum < 10 || sum > 10.01 {
+		t.Errorf("GET latency sum %v", sum)
+	}
+	if types["luxsrv_request_duration_seconds"] != "histogram" || types["luxsrv_connections"] != "gauge" {
+		t.Errorf("families typed %v", types)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/clusterclient"
+	"github.com/maniktaneja/luxstor/replica"
+)
+
+// vbucket moves requested by the cluster manager during a rebalance, for
+// the bucket selected on the connection.
+//
+// "vb-move <vb> <node>" streams new writes of the vbucket to node,
+// backfills it from a snapshot and returns once node has caught up.
+// "vb-move-done <vb> <node>" stops the stream once this node has picked
+// up the map handing the vbucket over to its new owner.
+// "vb-move-abort <vb> <node>" stops the stream of a move the manager gave
+// up on. A move that fails here is stopped straight away.
+func handleVbucketMove(req *gomemcached.MCRequest, s *luxStor, id int) (ret *gomemcached.MCResponse) {
+	ret = &gomemcached.MCResponse{}
+
+	var vb int
+	var dst string
+
+	if n, err := fmt.Sscanf(string(req.Key), "vb-move %d %s", &vb, &dst); err == nil && n == 2 {
+		log.Printf("Moving bucket %s vbucket %d to %s", s.name, vb, dst)
+		if err := backfillVbucket(s, vb, dst); err != nil {
+			log.Printf("Move of vbucket %d to %s failed. Error %v", vb, dst, err)
+			ret.Status = gomemcached.TMPFAIL
+			ret.Body = []byte(err.Error())
+		}
+	} else if n, err := fmt.Sscanf(string(req.Key), "vb-move-done %d %s", &vb, &dst); err == nil && n == 2 {
+		if err := replica.EndMove(s.name, vb, dst); err != nil {
+			ret.Status = gomemcached.TMPFAIL
+			ret.Body = []byte(err.Error())
+		}
+		log.Printf("Move of vbucket %d to %s done", vb, dst)
+	} else if n, err := fmt.Sscanf(string(req.Key), "vb-move-abort %d %s", &vb, &dst); err == nil && n == 2 {
+		replica.AbortMove(s.name, vb, dst)
+		log.Printf("Move of vbucket %d to %s aborted", vb, dst)
+	} else {
+		ret.Status = gomemcached.EINVAL
+	}
+
+	return
+}
+
+func backfillVbucket(s *luxStor, vb int, dst string) error {
+	move := replica.StartMove(s.name, vb, dst)
+	if err := backfill(s, move, vb); err != nil {
+		replica.AbortMove(s.name, vb, dst)
+		return err
+	}
+	return nil
+}
+
+func backfill(s *luxStor, move *replica.VbucketMove, vb int) error {
+
+	snap := s.memdb.NewSnapshot()
+	defer snap.Close()
+
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	// the store keeps every version of a key in order, only the last
+	// one of each key is sent
+	var prev byteItem
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		bItem := byteItem(itr.Get().Bytes())
+		if prev != nil && !bytes.Equal(prev.Key(), bItem.Key()) {
+			if err := backfillItem(move, vb, prev); err != nil {
+				return err
+			}
+		}
+		prev = bItem
+	}
+
+	if prev != nil {
+		if err := backfillItem(move, vb, prev); err != nil {
+			return err
+		}
+	}
+
+	return move.Wait()
+}
+
+func backfillItem(move *replica.VbucketMove, vb int, itm byteItem) error {
+	if int(client.FindShard(string(itm.Key()))) != vb || itm.Expired() {
+		return nil
+	}
+	return move.Backfill(itm.Key(), itm.Value(), itm.Expiry())
+}
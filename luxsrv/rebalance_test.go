@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/server"
+	"github.com/maniktaneja/luxstor/clusterclient"
+	"github.com/maniktaneja/luxstor/replica"
+)
+
+// the other node of a two node cluster, keeping its items in a map
+type peerNode struct {
+	lock  sync.Mutex
+	items map[string]string
+	flags map[string]uint32 // write flags of the last write of each key
+}
+
+func (p *peerNode) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := string(req.Key)
+	switch req.Opcode {
+	case gomemcached.VERSION:
+		return &gomemcached.MCResponse{Body: []byte(version)}
+	case gomemcached.GET:
+		v, ok := p.items[key]
+		if !ok {
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		}
+		return &gomemcached.MCResponse{Body: []byte(v)}
+	case gomemcached.SET, gomemcached.SETQ, gomemcached.DELETE, gomemcached.DELETEQ:
+		if req.Opcode == gomemcached.SET || req.Opcode == gomemcached.SETQ {
+			p.items[key] = string(req.Body)
+		} else {
+			delete(p.items, key)
+		}
+		p.flags[key] = replica.WriteFlags(req)
+		if req.Opcode == gomemcached.SETQ || req.Opcode == gomemcached.DELETEQ {
+			return nil
+		}
+	}
+	return &gomemcached.MCResponse{}
+}
+
+func (p *peerNode) get(key string) (string, uint32) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.items[key], p.flags[key]
+}
+
+// a cluster manager serving the map set with publish
+type fakeManager struct {
+	lock   sync.Mutex
+	rev    int
+	luxmap string
+}
+
+func (m *fakeManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/nodes" {
+		return
+	}
+	var rev int
+	fmt.Sscan(req.FormValue("rev"), &rev)
+	m.lock.Lock()
+	if rev >= m.rev {
+		// a short long poll
+		m.lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		m.lock.Lock()
+	}
+	fmt.Fprintf(w, `{"nodes":{"luxMap":%q},"buckets":{"default":{"luxmap":%q}},"term":1,"rev":%d}`,
+		m.luxmap, m.luxmap, m.rev)
+	m.lock.Unlock()
+}
+
+// publish a map and wait for the node to pick it up
+func (m *fakeManager) publish(t *testing.T, vbuckets ...string) {
+	m.lock.Lock()
+	m.rev++
+	rev := m.rev
+	m.luxmap = ""
+	for i, vb := range vbuckets {
+		if i > 0 {
+			m.luxmap += ","
+		}
+		m.luxmap += vb
+	}
+	m.lock.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); client.GetRev() < uint64(rev); {
+		if time.Now().After(deadline) {
+			t.Fatalf("map rev %d not picked up", rev)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// a key of each vbucket
+func vbucketKeys() []string {
+	keys := make([]string, client.VbucketCount)
+	for i, found := 0, 0; found < len(keys); i++ {
+		k := fmt.Sprintf("key%d", i)
+		if vb := client.FindShard(k); keys[vb] == "" {
+			keys[vb] = k
+			found++
+		}
+	}
+	return keys
+}
+
+// this node and a peer: writes and reads of the peer's keys are proxied
+// to it, and a vbucket moved to it is backfilled and streamed until the
+// move ends
+func TestProxyAndMove(t *testing.T) {
+	p := &peerNode{items: make(map[string]string), flags: make(map[string]uint32)}
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	go func() {
+		for {
+			c, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go memcached.HandleIO(c, p)
+		}
+	}()
+	peer := ls.Addr().String()
+	self := "127.0.0.1:1"
+
+	mgr := &fakeManager{}
+	srv := httptest.NewServer(mgr)
+	defer srv.Close()
+	setupBucket(t)
+	replica.Init(srv.URL, self)
+	// later tests run on a node that owns everything
+	defer mgr.publish(t, self, self)
+
+	keys := vbucketKeys()
+	mgr.publish(t, peer, self)
+	rh := &reqHandler{bucket: client.DefaultBucket}
+	set := func(key, value string) gomemcached.Status {
+		return rh.HandleMessage(nil, &gomemcached.MCRequest{
+			Opcode: gomemcached.SET, Key: []byte(key), Body: []byte(value), Extras: make([]byte, 8),
+		}).Status
+	}
+
+	// vbucket 0 is the peer's
+	if status := set(keys[0], "proxied"); status != gomemcached.SUCCESS {
+		t.Fatalf("proxied set failed: %v", status)
+	}
+	if v, flags := p.get(keys[0]); v != "proxied" || flags != replica.WriteProxied {
+		t.Errorf("peer has %q with flags %d", v, flags)
+	}
+	// a write proxied here by a node with another map is not sent back
+	bounced := &gomemcached.MCRequest{Opcode: gomemcached.SET, Key: []byte(keys[0]), Body: []byte("bounced"), Extras: make([]byte, 8)}
+	bounced.Extras[3] = replica.WriteProxied
+	if res := rh.HandleMessage(nil, bounced); res.Status != gomemcached.NOT_MY_VBUCKET {
+		t.Errorf("proxied write to a node that doesn't own the key returned %v", res.Status)
+	}
+	if v, _ := p.get(keys[0]); v != "proxied" {
+		t.Errorf("proxied write forwarded again, peer has %q", v)
+	}
+	res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte(keys[0])})
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "proxied" {
+		t.Errorf("proxied get returned %v %q", res.Status, res.Body)
+	}
+	if s := getBucket(client.DefaultBucket); s.memdb.ItemsCount() != 0 {
+		t.Errorf("proxied write kept on this node")
+	}
+
+	// vbucket 1 is moved from this node to the peer
+	set(keys[1], "before")
+	if res := admin(fmt.Sprintf("vb-move 1 %s", peer)); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("move failed: %v %s", res.Status, res.Body)
+	}
+	if v, flags := p.get(keys[1]); v != "before" || flags != replica.WriteReplicated {
+		t.Errorf("backfill sent %q with flags %d", v, flags)
+	}
+
+	set(keys[1], "during")
+	if err := replica.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := p.get(keys[1]); v != "during" {
+		t.Errorf("write during the move not streamed, peer has %q", v)
+	}
+
+	if res := admin(fmt.Sprintf("vb-move-abort 1 %s", peer)); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("abort failed: %v", res.Status)
+	}
+	set(keys[1], "after")
+	replica.Drain(time.Second)
+	if v, _ := p.get(keys[1]); v != "during" {
+		t.Errorf("write streamed after the move was aborted, peer has %q", v)
+	}
+
+	// a move that ends once the map hands the vbucket over
+	if res := admin(fmt.Sprintf("vb-move 1 %s", peer)); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("move failed: %v %s", res.Status, res.Body)
+	}
+	mgr.publish(t, peer, peer)
+	if res := admin(fmt.Sprintf("vb-move-done 1 %s", peer)); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("move done failed: %v", res.Status)
+	}
+	if v, _ := p.get(keys[1]); v != "after" {
+		t.Errorf("peer has %q after the move", v)
+	}
+	if status := set(keys[1], "moved"); status != gomemcached.SUCCESS {
+		t.Fatalf("set after the move failed: %v", status)
+	}
+	if v, flags := p.get(keys[1]); v != "moved" || flags != replica.WriteProxied {
+		t.Errorf("set after the move not proxied to the new owner, peer has %q with flags %d", v, flags)
+	}
+}
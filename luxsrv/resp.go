@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/auth"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// RESP2, the redis protocol. Like the text protocol, commands are turned
+// into binary requests and go through the same handlers, so keys of other
+// nodes are proxied and writes replicated. Counters are unsigned as in
+// memcached: DECR stops at 0 and DECR of a missing key sets it to 0.
+// Expirations are kept in seconds, PX is rounded up. SCAN lists the keys
+// owned by the node it is sent to. Clients log in with AUTH user password
+
+// Most arguments accepted in one command, MSET takes up to 511 pairs
+var respMaxArgs = 1024
+
+// Most bytes of bulk strings in one command
+var respMaxCommandSize = 32 * 1024 * 1024
+
+// Time a SCAN cursor is kept after it was handed out
+var respCursorTTL = 10 * time.Minute
+
+var errRespProtocol = errors.New("Protocol error")
+
+func waitForRespConnections(ls *clientListener) {
+	log.Printf("Listening for the redis protocol on %s", ls.Addr())
+	acceptLoop(ls, respConnectionHandler)
+}
+
+func respConnectionHandler(c *clientConn) {
+	conn, err := startConn(c)
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("Dropping connection from %v: %v", c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+	defer conn.Close()
+
+	rh := &reqHandler{bucket: client.DefaultBucket, conn: c}
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readRespCommand(r)
+		if err == errRespProtocol {
+			respError(w, "ERR Protocol error")
+			w.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			c.idle()
+			continue
+		}
+		if !handleRespCommand(rh, args, w) {
+			w.Flush()
+			return
+		}
+		c.idle()
+		// answer pipelined commands together
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readRespCommand reads an array of bulk strings, or an inline command
+// as typed in telnet
+func readRespCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readRespLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		var args [][]byte
+		for _, f := range strings.Fields(string(line)) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, errRespProtocol
+	}
+	var args [][]byte
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readRespLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRespProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > asciiMaxItemSize || total+size > respMaxCommandSize {
+			return nil, errRespProtocol
+		}
+		total += size
+		// the buffer grows as the data arrives, not from the length alone
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(size)+2); err != nil {
+			return nil, err
+		}
+		arg := buf.Bytes()
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errRespProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readRespLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errRespProtocol
+	} else if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+func respSimple(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "+%s\r\n", s)
+}
+
+func respError(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "-%s\r\n", s)
+}
+
+func respInt(w *bufio.Writer, n uint64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+// a nil value is sent as the null bulk string
+func respBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func respArray(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// handleRespCommand runs one command, returns false to close the
+// connection
+func handleRespCommand(rh *reqHandler, args [][]byte, w *bufio.Writer) bool {
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	wrongArgs := func() {
+		respError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+	}
+	get := func(key []byte) (*gomemcached.MCResponse, bool) {
+		res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: key})
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			if res.Body == nil {
+				// an empty value, not a missing one
+				res.Body = []byte{}
+			}
+			return res, true
+		case gomemcached.KEY_ENOENT:
+			return nil, true
+		}
+		respError(w, rh.respFailure(res.Status))
+		return nil, false
+	}
+
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			respBulk(w, args[0])
+		} else {
+			respSimple(w, "PONG")
+		}
+
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs()
+			break
+		}
+		respBulk(w, args[0])
+
+	case "QUIT":
+		respSimple(w, "OK")
+		return false
+
+	case "AUTH":
+		if len(args) != 2 {
+			wrongArgs()
+			break
+		}
+		rh.user = ""
+		name := string(args[0])
+		if u := lookupUser(name); u == nil || !u.CheckPassword(string(args[1])) {
+			authFailed(name)
+			respError(w, "WRONGPASS invalid username-password pair or user is disabled.")
+			break
+		}
+		rh.user = name
+		respSimple(w, "OK")
+
+	case "GET":
+		if len(args) != 1 {
+			wrongArgs()
+			break
+		}
+		if res, ok := get(args[0]); ok {
+			if res == nil {
+				respBulk(w, nil)
+			} else {
+				respBulk(w, res.Body)
+			}
+		}
+
+	case "MGET":
+		if len(args) == 0 {
+			wrongArgs()
+			break
+		}
+		values := make([][]byte, len(args))
+		failed := false
+		for i, key := range args {
+			res, ok := get(key)
+			if !ok {
+				failed = true
+				break
+			}
+			if res != nil {
+				values[i] = res.Body
+			}
+		}
+		if failed {
+			break
+		}
+		respArray(w, len(values))
+		for _, v := range values {
+			respBulk(w, v)
+		}
+
+	case "EXISTS":
+		if len(args) == 0 {
+			wrongArgs()
+			break
+		}
+		var n uint64
+		failed := false
+		for _, key := range args {
+			res, ok := get(key)
+			if !ok {
+				failed = true
+				break
+			}
+			if res != nil {
+				n++
+			}
+		}
+		if !failed {
+			respInt(w, n)
+		}
+
+	case "SET":
+		if len(args) < 2 {
+			wrongArgs()
+			break
+		}
+		req, err := respSet(args)
+		if err != "" {
+			respError(w, err)
+			break
+		}
+		res := rh.HandleMessage(nil, req)
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			respSimple(w, "OK")
+		case gomemcached.KEY_EEXISTS, gomemcached.KEY_ENOENT:
+			// NX or XX not met
+			respBulk(w, nil)
+		default:
+			respError(w, rh.respFailure(res.Status))
+		}
+
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			wrongArgs()
+			break
+		}
+		// not atomic, the pairs are set one after the other
+		failed := false
+		for i := 0; i < len(args); i += 2 {
+			res := rh.HandleMessage(nil, &gomemcached.MCRequest{
+				Opcode: gomemcached.SET,
+				Key:    args[i],
+				Body:   args[i+1],
+				Extras: make([]byte, 8),
+			})
+			if res.Status != gomemcached.SUCCESS {
+				respError(w, rh.respFailure(res.Status))
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			respSimple(w, "OK")
+		}
+
+	case "DEL":
+		if len(args) == 0 {
+			wrongArgs()
+			break
+		}
+		var n uint64
+		failed := false
+		for _, key := range args {
+			res := rh.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: key})
+			if res.Status == gomemcached.SUCCESS {
+				n++
+			} else if res.Status != gomemcached.KEY_ENOENT {
+				respError(w, rh.respFailure(res.Status))
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			respInt(w, n)
+		}
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		delta := int64(1)
+		if cmd == "INCRBY" || cmd == "DECRBY" {
+			if len(args) != 2 {
+				wrongArgs()
+				break
+			}
+			var err error
+			if delta, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+				respError(w, "ERR value is not an integer or out of range")
+				break
+			}
+		} else if len(args) != 1 {
+			wrongArgs()
+			break
+		}
+		if cmd == "DECR" || cmd == "DECRBY" {
+			delta = -delta
+		}
+
+		req := &gomemcached.MCRequest{Opcode: gomemcached.INCREMENT, Key: args[0], Extras: make([]byte, 20)}
+		if delta < 0 {
+			req.Opcode = gomemcached.DECREMENT
+			binary.BigEndian.PutUint64(req.Extras, uint64(-delta))
+		} else {
+			binary.BigEndian.PutUint64(req.Extras, uint64(delta))
+			// a missing key counts from 0
+			binary.BigEndian.PutUint64(req.Extras[8:], uint64(delta))
+		}
+
+		res := rh.HandleMessage(nil, req)
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			respInt(w, binary.BigEndian.Uint64(res.Body))
+		case gomemcached.DELTA_BADVAL:
+			respError(w, "ERR value is not an integer or out of range")
+		default:
+			respError(w, rh.respFailure(res.Status))
+		}
+
+	case "SCAN":
+		if len(args) == 0 {
+			wrongArgs()
+			break
+		}
+		handleRespScan(rh, args, w)
+
+	case "INFO":
+		req := &gomemcached.MCRequest{Opcode: gomemcached.GAT}
+		section := "Stats"
+		if len(args) > 0 && strings.ToLower(string(args[0])) == "connections" {
+			req.Key = []byte("connections")
+			section = "Connections"
+		}
+		res := rh.HandleMessage(nil, req)
+		if res.Status != gomemcached.SUCCESS {
+			respError(w, rh.respFailure(res.Status))
+			break
+		}
+		var info bytes.Buffer
+		fmt.Fprintf(&info, "# %s\r\n", section)
+		for _, stat := range strings.Split(string(res.Body), "\n") {
+			// "name value", names of replication stats hold host:port
+			if i := strings.LastIndex(stat, " "); i >= 0 {
+				fmt.Fprintf(&info, "%s:%s\r\n", strings.Replace(stat[:i], ":", "_", -1), stat[i+1:])
+			}
+		}
+		respBulk(w, info.Bytes())
+
+	default:
+		respError(w, fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+	}
+	return true
+}
+
+// respSet turns SET key value [EX seconds|PX milliseconds] [NX|XX] into a
+// set, add or replace. Returns the error to send back for bad options
+func respSet(args [][]byte) (*gomemcached.MCRequest, string) {
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    args[0],
+		Body:   args[1],
+		Extras: make([]byte, 8),
+	}
+
+	var secs int64
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX", "XX":
+			if req.Opcode != gomemcached.SET {
+				return nil, "ERR syntax error"
+			}
+			req.Opcode = gomemcached.ADD
+			if opt == "XX" {
+				req.Opcode = gomemcached.REPLACE
+			}
+		case "EX", "PX":
+			if secs != 0 || i+1 == len(args) {
+				return nil, "ERR syntax error"
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				return nil, "ERR value is not an integer or out of range"
+			}
+			if n <= 0 || n > 1<<31 {
+				return nil, "ERR invalid expire time in 'set' command"
+			}
+			secs = n
+			if opt == "PX" {
+				secs = (n + 999) / 1000
+			}
+		default:
+			return nil, "ERR syntax error"
+		}
+	}
+
+	binary.BigEndian.PutUint32(req.Extras[4:], ttlExpiry(secs))
+	return req, ""
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func handleRespScan(rh *reqHandler, args [][]byte, w *bufio.Writer) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		respError(w, "ERR invalid cursor")
+		return
+	}
+	var pattern string
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			respError(w, "ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				respError(w, "ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			respError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	if !rh.allowed(rh.bucket, auth.Read) {
+		respError(w, rh.respFailure(gomemcached.EACCESS))
+		return
+	}
+	s := getBucket(rh.bucket)
+	if s == nil {
+		respError(w, rh.respFailure(gomemcached.NO_BUCKET))
+		return
+	}
+
+	var start []byte
+	if cursor != 0 {
+		var ok bool
+		if start, ok = takeCursor(cursor, s.name); !ok {
+			respError(w, "ERR invalid cursor")
+			return
+		}
+	}
+
+	keys, next := s.scan(start, count)
+	cursor = 0
+	if next != nil {
+		cursor = saveCursor(s.name, next)
+	}
+
+	var matched [][]byte
+	for _, key := range keys {
+		if pattern == "" || globMatch(pattern, string(key)) {
+			matched = append(matched, key)
+		}
+	}
+	respArray(w, 2)
+	respBulk(w, []byte(strconv.FormatUint(cursor, 10)))
+	respArray(w, len(matched))
+	for _, key := range matched {
+		respBulk(w, key)
+	}
+}
+
+// the error sent for a failed request
+func (rh *reqHandler) respFailure(status gomemcached.Status) string {
+	switch status {
+	case gomemcached.EACCESS:
+		if rh.user == "" {
+			return "NOAUTH Authentication required."
+		}
+		return "NOPERM this user has no permissions to run this command on the bucket"
+	case gomemcached.ENOMEM:
+		return "OOM command not allowed, the bucket is over its quota"
+	case gomemcached.NOT_MY_VBUCKET:
+		return "MOVED the key is on another node"
+	case gomemcached.TMPFAIL:
+		return "TRYAGAIN temporary failure"
+	case gomemcached.NO_BUCKET:
+		return "ERR no bucket"
+	}
+	return "ERR " + status.String()
+}
+
+// SCAN cursors hold the key a scan carries on from. They are not tied to
+// a connection, clients may go on with a scan over another one
+type respCursor struct {
+	bucket string
+	next   []byte
+	saved  time.Time
+}
+
+var cursorLock sync.Mutex
+var cursors = make(map[uint64]*respCursor)
+
+// cursors of an earlier run of the node must not be taken for new ones
+var lastCursor = uint64(time.Now().UnixNano())
+
+func saveCursor(bucket string, next []byte) uint64 {
+	cursorLock.Lock()
+	defer cursorLock.Unlock()
+
+	now := time.Now()
+	for id, c := range cursors {
+		if now.Sub(c.saved) > respCursorTTL {
+			delete(cursors, id)
+		}
+	}
+	lastCursor++
+	if lastCursor == 0 {
+		lastCursor++
+	}
+	cursors[lastCursor] = &respCursor{bucket, next, now}
+	return lastCursor
+}
+
+// takeCursor returns the key to go on from, a cursor can be used once
+func takeCursor(id uint64, bucket string) ([]byte, bool) {
+	cursorLock.Lock()
+	defer cursorLock.Unlock()
+
+	c, ok := cursors[id]
+	if !ok || c.bucket != bucket {
+		return nil, false
+	}
+	delete(cursors, id)
+	return c.next, true
+}
+
+// globMatch matches redis patterns: * ? [abc] [^a-z] and \ to escape.
+// A mismatch after a * goes back to let that * take one more byte, earlier
+// stars never need to, so long patterns can't backtrack exponentially
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, n := globOne(pattern[p:], s[i]); ok {
+				p += n
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		mark++
+		p, i = star+1, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globOne matches a byte against the first element of a pattern, other
+// than *, and returns the element's length
+func globOne(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// no closing bracket, taken literally
+			return c == '[', 1
+		}
+		class := pattern[1 : end+1]
+		negate := len(class) > 0 && class[0] == '^'
+		if negate {
+			class = class[1:]
+		}
+		match := false
+		for i := 0; i < len(class); i++ {
+			if i+2 < len(class) && class[i+1] == '-' {
+				if class[i] <= c && c <= class[i+2] {
+					match = true
+				}
+				i += 2
+			} else if class[i] == c {
+				match = true
+			}
+		}
+		return match != negate, end + 2
+	case '\\':
+		if len(pattern) > 1 {
+			return c == pattern[1], 2
+		}
+	}
+	return c == pattern[0], 1
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadRespCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\nget k\r\n*1\r\n$2\r\nxyz\r\n"))
+
+	args, err := readRespCommand(r)
+	if err != nil || len(args) != 3 || string(args[2]) != "a\r\nb" {
+		t.Errorf("array command read as %q, %v", args, err)
+	}
+	args, err = readRespCommand(r)
+	if err != nil || len(args) != 2 || string(args[0]) != "get" {
+		t.Errorf("inline command read as %q, %v", args, err)
+	}
+	if _, err = readRespCommand(r); err != errRespProtocol {
+		t.Errorf("bad bulk length not refused: %v", err)
+	}
+
+	for _, in := range []string{"*-1\r\n", "*1\r\n$-1\r\n", "*1\r\n$-5\r\n"} {
+		r := bufio.NewReader(strings.NewReader(in))
+		if _, err := readRespCommand(r); err != errRespProtocol {
+			t.Errorf("negative length in %q not refused: %v", in, err)
+		}
+	}
+
+	defer func(n int) { respMaxCommandSize = n }(respMaxCommandSize)
+	respMaxCommandSize = 8
+	for _, in := range []string{"*1025\r\n", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\n"} {
+		r := bufio.NewReader(strings.NewReader(in))
+		if _, err := readRespCommand(r); err != errRespProtocol {
+			t.Errorf("oversized command %q not refused: %v", in, err)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"key:*", "key:1", true},
+		{"key:*", "other", false},
+		{"*/b", "a/b", true},
+		{"k?y", "key", true},
+		{"k?y", "ky", false},
+		{"k[ae]y", "key", true},
+		{"k[^ae]y", "key", false},
+		{"k[a-f]y", "kdy", true},
+		{"k\\*y", "k*y", true},
+		{"k\\*y", "key", false},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXbY", false},
+		{"*[0-9]", "key1", true},
+		{"[", "[", true},
+		{"k\\", "k\\", true},
+		{"a*", "b", false},
+		{strings.Repeat("*a", 30) + "*b", strings.Repeat("a", 60), false},
+	}
+	for _, test := range tests {
+		if globMatch(test.pattern, test.s) != test.match {
+			t.Errorf("globMatch(%q, %q) != %v", test.pattern, test.s, test.match)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/maniktaneja/luxstor/replica"
+)
+
+// On SIGTERM or SIGINT the node stops accepting connections and asks the
+// cluster managers to fail it over, so clients and other nodes go to its
+// replicas from then on. It then lets the requests in progress finish,
+// sends what is left in the replication queues and optionally dumps the
+// items it owned. A second signal exits straight away
+
+// time allowed to tell the managers the node is leaving
+var leaveTimeout = 10 * time.Second
+
+var shuttingDown int32
+
+var listenersLock sync.Mutex
+var listeners []net.Listener
+
+// the http server, if any, is shut down on its own
+var httpSrv *http.Server
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// listen opens a listener for protocol that is closed on shutdown
+func listen(port int, protocol string) *clientListener {
+	ls, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatalf("Got an error:  %s", err)
+	}
+	listenersLock.Lock()
+	listeners = append(listeners, ls)
+	listenersLock.Unlock()
+	return &clientListener{Listener: ls, protocol: protocol}
+}
+
+// waitForShutdown blocks until a signal and shuts the node down
+func waitForShutdown() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.Printf("Got %v, shutting down", sig)
+	go func() {
+		<-sigs
+		log.Printf("Got a second signal, exiting now")
+		os.Exit(1)
+	}()
+
+	shutdown()
+	log.Printf("Shutdown complete")
+}
+
+func shutdown() {
+	deadline := time.Now().Add(*drainTimeout)
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	listenersLock.Lock()
+	for _, ls := range listeners {
+		ls.Close()
+	}
+	listenersLock.Unlock()
+
+	// what this node owns is dumped, not what the map says once it has left
+	owned := make(map[string]func(key []byte) bool)
+	bucketsLock.RLock()
+	for name := range buckets {
+		owned[name] = replica.Owned(name)
+	}
+	bucketsLock.RUnlock()
+
+	if err := replica.Leave(leaveTimeout); err != nil {
+		log.Printf("Cannot tell the cluster managers this node is leaving: %v", err)
+	}
+
+	httpDone := make(chan bool)
+	go func() {
+		if httpSrv != nil {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			if err := httpSrv.Shutdown(ctx); err != nil {
+				log.Printf("http requests still running at the deadline: %v", err)
+			}
+			cancel()
+		}
+		close(httpDone)
+	}()
+
+	drainConns()
+	for openConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := openConns(); n > 0 {
+		// their handlers close them once reads and writes fail
+		log.Printf("%d connections still open at the deadline, closing them", n)
+		connsLock.Lock()
+		for c := range conns {
+			c.SetDeadline(time.Now())
+		}
+		connsLock.Unlock()
+	}
+	<-httpDone
+
+	if err := replica.Drain(time.Until(deadline)); err != nil {
+		log.Printf("Replication queues not drained: %v", err)
+	} else {
+		log.Printf("Replication queues drained")
+	}
+
+	if *shutdownSnapshot != "" {
+		if err := writeSnapshots(*shutdownSnapshot, owned); err != nil {
+			log.Printf("Cannot write the shutdown snapshot: %v", err)
+		}
+	}
+}
+
+// drainConns fails the reads waiting for the next request right away, a
+// request being read or handled still gets its response written first
+func drainConns() {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	log.Printf("Draining %d connections", len(conns))
+	for c := range conns {
+		if c.protocol != "http" {
+			c.drain()
+		}
+	}
+}
+
+// writeSnapshots writes the items this node owns in each bucket to
+// <dir>/<bucket>.jsonl, one json object per line
+func writeSnapshots(dir string, owned map[string]func(key []byte) bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	bucketsLock.RLock()
+	var names []string
+	stores := make(map[string]*luxStor, len(buckets))
+	for name, s := range buckets {
+		names = append(names, name)
+		stores[name] = s
+	}
+	bucketsLock.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(dir, name+".jsonl")
+		isOwned := owned[name]
+		if isOwned == nil {
+			// created while shutting down
+			isOwned = replica.Owned(name)
+		}
+		n, err := stores[name].writeSnapshot(path, isOwned)
+		if err != nil {
+			return fmt.Errorf("bucket %s: %v", name, err)
+		}
+		log.Printf("Wrote %d items of bucket %s to %s", n, name, path)
+	}
+	return nil
+}
+
+// writeSnapshot dumps the live items of this node's vbuckets, written to
+// a temporary file first so a snapshot is never left half written
+func (s *luxStor) writeSnapshot(path string, owned func(key []byte) bool) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	snap := s.memdb.NewSnapshot()
+	defer snap.Close()
+	itr := snap.NewIterator()
+	defer itr.Close()
+
+	n := 0
+	var prev []byte
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		bItem := byteItem(itr.Get().Bytes())
+		key := bItem.Key()
+		if prev != nil && bytes.Equal(prev, key) {
+			continue
+		}
+		prev = key
+		if bItem.Expired() || !owned(key) {
+			continue
+		}
+		if err := enc.Encode(newKVItem(key, bItem.Value(), bItem.Expiry())); err != nil {
+			f.Close()
+			return n, err
+		}
+		n++
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, path)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wait for the server to start reading a request
+func waitForBusy(t *testing.T) {
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		connsLock.Lock()
+		n := 0
+		for c := range conns {
+			n += int(atomic.LoadInt32(&c.busy))
+		}
+		connsLock.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("request not read")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// idle connections are closed at once, a request in progress is answered
+// first
+func TestDrain(t *testing.T) {
+	setupBucket(t)
+	addr := startTextServer(t)
+	t.Cleanup(func() { atomic.StoreInt32(&shuttingDown, 0) })
+
+	idle, busy := dialText(t, addr), dialText(t, addr)
+	if idle.call("version\r\n") != "VERSION "+version {
+		t.Fatalf("connection not served")
+	}
+	busy.Write([]byte("set k 0 0 5\r\nab"))
+	waitForBusy(t)
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	drainConns()
+	if !idle.closed() {
+		t.Errorf("idle connection not closed")
+	}
+	if res := busy.call("cde\r\n"); res != "STORED" {
+		t.Errorf("request in progress answered with %q", res)
+	}
+	if !busy.closed() {
+		t.Errorf("connection not closed after its request")
+	}
+
+	// accepted just before the listener is closed
+	if late := dialText(t, addr); late.call("version\r\n") != "" {
+		t.Errorf("connection served during shutdown")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maniktaneja/luxstor/clusterclient"
+	"github.com/maniktaneja/luxstor/replica"
+	"github.com/maniktaneja/luxstor/tlsconf"
+)
+
+// With -tlsCert the node's port takes TLS connections as well as plain
+// ones, told apart by their first byte: a TLS handshake starts with a
+// handshake record (0x16), a memcached request with its magic (0x80).
+// Serving both on one port keeps the node's id in the map the same, so
+// other nodes reach it over TLS at the address they already know
+
+const tlsHandshakeRecord = 0x16
+
+// Time a client has to complete the TLS handshake
+var tlsHandshakeTimeout = 10 * time.Second
+
+// config of the TLS listener, nil if there is none
+var serverTLS *tls.Config
+
+var errPlainRefused = errors.New("plain connection refused, TLS is required")
+
+// set up the listener and the connections to the managers and the other
+// nodes from the -tls flags
+func initTLS() {
+	if *tlsCert != "" {
+		cfg, err := tlsconf.Server(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatalf("Cannot load TLS certificate: %v", err)
+		}
+		serverTLS = cfg
+	} else if *requireTLS {
+		log.Fatalf("-requireTLS needs -tlsCert")
+	}
+
+	if *tlsCA != "" || *tlsNodes {
+		cfg, err := tlsconf.Client(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatalf("Cannot load TLS certificate: %v", err)
+		}
+		// used for https cluster manager urls
+		client.TLSConfig = cfg
+		if *tlsNodes {
+			replica.TLSConfig = cfg
+		}
+	}
+}
+
+// a connection whose first bytes were read to tell TLS from plain
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// startConn returns the connection to serve requests on, which is c
+// itself unless TLS is enabled
+func startConn(c *clientConn) (net.Conn, error) {
+	if serverTLS == nil {
+		c.serving()
+		return c, nil
+	}
+
+	// a client that never sends a byte must not keep its connection slot
+	wait := tlsHandshakeTimeout
+	if *idleTimeout > 0 && *idleTimeout < wait {
+		wait = *idleTimeout
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(wait))
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	conn := &peekedConn{c, br}
+
+	if first[0] != tlsHandshakeRecord {
+		if *requireTLS {
+			return nil, errPlainRefused
+		}
+		c.serving()
+		return conn, nil
+	}
+
+	tc := tls.Server(conn, serverTLS)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	c.serving()
+	return &tlsConn{Conn: tc}, nil
+}
+
+// tlsConn closes a TLS connection without an error, tls.Conn.Close fails
+// when the close_notify alert can't be written and HandleIO panics if
+// Close fails
+type tlsConn struct {
+	*tls.Conn
+	closeOnce sync.Once
+}
+
+func (c *tlsConn) Close() error {
+	c.closeOnce.Do(func() { c.Conn.Close() })
+	return nil
+}
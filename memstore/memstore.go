@@ -126,7 +126,7 @@ func (w *Writer) Get(x *Item) *Item {
 		curr = next
 	}
 
-	if curr.deadSn != 0 {
+	if atomic.LoadUint32(&curr.deadSn) != 0 {
 		return nil
 	}
 
@@ -141,6 +141,9 @@ type MemStore struct {
 	lastGCSn    uint32
 	count       int64
 
+	gcRuns        uint64
+	deadCollected uint64
+
 	keyCmp  KeyCompare
 	insCmp  CompareFn
 	iterCmp CompareFn
@@ -250,7 +253,7 @@ loop:
 		return
 	}
 	itm := it.iter.Get().(*Item)
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
+	if deadSn := atomic.LoadUint32(&itm.deadSn); itm.bornSn > it.snap.sn || (deadSn > 0 && deadSn <= it.snap.sn) {
 		it.iter.Next()
 		goto loop
 	}
@@ -309,7 +312,7 @@ func (m *MemStore) Rollback(snap *Snapshot) {
 	iter.SeekFirst()
 	for ; iter.Valid(); iter.Next() {
 		itm := iter.Get().(*Item)
-		if itm.bornSn > snap.sn || itm.deadSn > snap.sn {
+		if itm.bornSn > snap.sn || atomic.LoadUint32(&itm.deadSn) > snap.sn {
 			m.store.Delete(itm, m.insCmp, buf2)
 		}
 	}
@@ -325,8 +328,10 @@ func (m *MemStore) collectDead(sn uint32) {
 	iter.SeekFirst()
 	for ; iter.Valid(); iter.Next() {
 		itm := iter.Get().(*Item)
-		if itm.deadSn > 0 && itm.deadSn <= sn {
-			m.store.Delete(itm, m.insCmp, buf2)
+		if deadSn := atomic.LoadUint32(&itm.deadSn); deadSn > 0 && deadSn <= sn {
+			if m.store.Delete(itm, m.insCmp, buf2) {
+				atomic.AddUint64(&m.deadCollected, 1)
+			}
 		}
 	}
 }
@@ -341,6 +346,7 @@ func (m *MemStore) GC() {
 		if snap.sn != m.lastGCSn && snap.sn > 1 {
 			m.lastGCSn = snap.sn - 1
 			m.collectDead(m.lastGCSn)
+			atomic.AddUint64(&m.gcRuns, 1)
 		}
 	}
 
@@ -362,3 +368,13 @@ func (m *MemStore) GetSnapshots() []*Snapshot {
 func (m *MemStore) DumpStats() string {
 	return m.store.GetStats().String()
 }
+
+func (m *MemStore) GetStats() StatsReport {
+	return m.store.GetStats()
+}
+
+// GCStats returns the number of garbage collections that collected dead
+// items and the number of items they collected
+func (m *MemStore) GCStats() (runs, collected uint64) {
+	return atomic.LoadUint64(&m.gcRuns), atomic.LoadUint64(&m.deadCollected)
+}
@@ -1,6 +1,9 @@
 package memstore
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
 
 type StatsReport struct {
 	ReadConflicts       uint64
@@ -39,16 +42,19 @@ func (s *Skiplist) GetStats() StatsReport {
 	var report StatsReport
 	var totalNextPtrs int
 	var totalNodes int
-	report.ReadConflicts = s.stats.readConflicts
-	report.InsertConflicts = s.stats.insertConflicts
+	report.ReadConflicts = atomic.LoadUint64(&s.stats.readConflicts)
+	report.InsertConflicts = atomic.LoadUint64(&s.stats.insertConflicts)
 
-	for i, c := range s.stats.levelNodesCount {
+	for i := range s.stats.levelNodesCount {
+		c := atomic.LoadInt64(&s.stats.levelNodesCount[i])
+		report.NodeDistribution[i] = c
 		totalNodes += int(c)
 		totalNextPtrs += (i + 1) * int(c)
 	}
 
 	report.NodeCount = totalNodes
-	report.NodeDistribution = s.stats.levelNodesCount
-	report.NextPointersPerNode = float64(totalNextPtrs) / float64(totalNodes)
+	if totalNodes > 0 {
+		report.NextPointersPerNode = float64(totalNextPtrs) / float64(totalNodes)
+	}
 	return report
 }
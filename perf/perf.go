@@ -7,7 +7,7 @@ import (
 	"github.com/couchbase/gomemcached/client"
 	"log"
 	"math/rand"
-	"runtime"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,6 +18,8 @@ var documentCount = flag.Int("documents", 100000, "no. of documents to populate"
 var threadCount = flag.Int("threads", 10, "no. of goroutines to spawn")
 var size = flag.Int("size", 512, "value size of documents")
 var readRatio = flag.Int("ratio", 4, "read ratio vs write")
+var user = flag.String("user", "", "user to log in as")
+var password = flag.String("password", "", "password of the user")
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
@@ -29,6 +31,26 @@ func RandStringRunes(n int) string {
 	return string(b)
 }
 
+// latencies of one kind of operation, each thread appends to its own
+type latencies [][]time.Duration
+
+// report logs the percentiles of the latencies
+func (l latencies) report(op string) {
+	var all []time.Duration
+	for _, t := range l {
+		all = append(all, t...)
+	}
+	if len(all) == 0 {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	pct := func(p float64) time.Duration {
+		return all[int(float64(len(all)-1)*p)]
+	}
+	log.Printf("%s latency: p50 %v p90 %v p99 %v p99.9 %v max %v\n",
+		op, pct(.5), pct(.9), pct(.99), pct(.999), all[len(all)-1])
+}
+
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
@@ -46,13 +68,22 @@ func main() {
 			log.Printf(" Unable to connect to %v, error %v", memServer, err)
 			return
 		}
+		if *user != "" {
+			if _, err := client.AuthScramSha(*user, *password); err != nil {
+				log.Printf(" Unable to log in as %v, error %v", *user, err)
+				return
+			}
+		}
 
 		c = append(c, client)
 	}
 
+	setLat := make(latencies, *threadCount)
+	getLat := make(latencies, *threadCount)
+
 	data := RandStringRunes(*size)
 	now := time.Now()
-	docPerThread := *documentCount / runtime.GOMAXPROCS(0)
+	docPerThread := *documentCount / *threadCount
 
 	for j := 0; j < *threadCount; j++ {
 		wg.Add(1)
@@ -62,18 +93,22 @@ func main() {
 
 			for i := 0; i < docPerThread; i++ {
 				docid := fmt.Sprintf("doc-%d", i+offset*docPerThread)
+				start := time.Now()
 				res, err := client.Set(0, docid, 0, 0, []byte(data))
 				if err != nil || res.Status != gomemcached.SUCCESS {
 					log.Printf("Set failed. Error %v", err)
 					return
 				}
+				setLat[offset] = append(setLat[offset], time.Since(start))
 
 				for k := 0; k < *readRatio; k++ {
+					start := time.Now()
 					res, err := client.Get(0, docid)
 					if err != nil || res.Status != gomemcached.SUCCESS {
 						log.Printf("Get failed. Error %v", err)
 						return
 					}
+					getLat[offset] = append(getLat[offset], time.Since(start))
 				}
 			}
 
@@ -82,8 +117,13 @@ func main() {
 
 	wg.Wait()
 	elapsed := time.Since(now)
-	ops := runtime.GOMAXPROCS(0) * docPerThread
+	ops := *threadCount * docPerThread
+	total := ops + ops**readRatio
 	log.Printf("sets:%d, gets:%d time_taken:%v\n", ops, ops**readRatio, elapsed)
+	log.Printf("throughput: %.0f ops/sec, sets: %.0f/sec\n",
+		float64(total)/elapsed.Seconds(), float64(ops)/elapsed.Seconds())
+	setLat.report("set")
+	getLat.report("get")
 
 	//log.Printf("Get returned %v", res)
 }
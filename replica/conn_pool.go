@@ -1,6 +1,7 @@
 package replica
 
 import (
+	"crypto/tls"
 	"errors"
 	"time"
 
@@ -42,6 +43,14 @@ func newConnectionPool(host string, poolSize, poolOverflow int) *connectionPool
 var ConnPoolCallback func(host string, source string, start time.Time, err error)
 
 func defaultMkConn(host string) (*memcached.Client, error) {
+	if TLSConfig != nil {
+		conn, err := tls.Dial("tcp", host, TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		return memcached.Wrap(conn)
+	}
+
 	conn, err := memcached.Connect("tcp", host)
 	if err != nil {
 		return nil, err
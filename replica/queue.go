@@ -0,0 +1,386 @@
+// per destination replication queues with retry and backoff
+
+package replica
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+)
+
+// what to do with a write when the destination queue is full
+const (
+	QueueBlock = iota // block the client until there is room
+	QueueFail         // fail the client write
+	QueueDrop         // drop the replication item and count it
+)
+
+// Size of the replication queue of each host, split across its workers
+var QueueSize = 100000
+
+// Number of workers draining the queue of each host. Keys are hashed to
+// workers so that writes to the same key are sent in order.
+var QueueWorkers = 4
+
+// Maximum number of quiet sets pipelined in one round trip
+var QueueBatchSize = 256
+
+// Policy applied when a per host queue is full
+var QueueFullPolicy = QueueBlock
+
+// Number of times a failed item is retried before it is dropped
+var QueueMaxRetries = 5
+
+// Initial and maximum backoff between retries of a failed item
+var QueueRetryBackoff = 10 * time.Millisecond
+var QueueMaxBackoff = 2 * time.Second
+
+// Time to wait for a connection to the remote host
+var QueueConnTimeout = 5 * time.Second
+
+var ErrQueueFull = errors.New("replication queue is full")
+
+// Counters kept for every destination host. Superseded writes failed but
+// a later write to the same key was sent after them, rejected ones were
+// refused under the fail policy and failed the client write instead
+type HostStats struct {
+	Queued     uint64
+	Sent       uint64
+	Retried    uint64
+	Dropped    uint64
+	Superseded uint64
+	Rejected   uint64
+	Depth      int
+}
+
+// a queue per host and bucket
+type hostQueue struct {
+	host    string
+	bucket  string
+	workers []chan *repItem
+	stats   HostStats
+}
+
+var queueLock sync.Mutex
+var queues = make(map[string]*hostQueue)
+
+func ParseQueuePolicy(s string) (int, error) {
+	switch s {
+	case "block":
+		return QueueBlock, nil
+	case "fail":
+		return QueueFail, nil
+	case "drop":
+		return QueueDrop, nil
+	}
+	return 0, fmt.Errorf("unknown queue policy %q", s)
+}
+
+func getQueue(host string, bucket string) *hostQueue {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	key := host + "/" + bucket
+	q, ok := queues[key]
+	if !ok {
+		q = &hostQueue{host: host, bucket: bucket}
+		size := QueueSize / QueueWorkers
+		if size < 1 {
+			size = 1
+		}
+		for i := 0; i < QueueWorkers; i++ {
+			ch := make(chan *repItem, size)
+			q.workers = append(q.workers, ch)
+			go q.drain(ch)
+		}
+		queues[key] = q
+	}
+	return q
+}
+
+// add an item to the queue of its destination host, applying the
+// queue full policy
+func enqueue(ri *repItem) error {
+	return enqueuePolicy(ri, QueueFullPolicy)
+}
+
+func enqueuePolicy(ri *repItem, policy int) error {
+	q := getQueue(ri.host, ri.bucket)
+	ch := q.workers[getHash(string(ri.req.Key))%uint32(len(q.workers))]
+
+	if policy == QueueBlock {
+		ch <- ri
+	} else {
+		select {
+		case ch <- ri:
+		default:
+			if policy == QueueFail {
+				atomic.AddUint64(&q.stats.Rejected, 1)
+				return ErrQueueFull
+			}
+			atomic.AddUint64(&q.stats.Dropped, 1)
+			return nil
+		}
+	}
+
+	atomic.AddUint64(&q.stats.Queued, 1)
+	return nil
+}
+
+// a write queued to several hosts. Under the fail policy only the first
+// full queue can fail the write, once a host has the item the write stands
+// and it is dropped for the hosts whose queues are full
+type writeQueuer struct {
+	policy int
+}
+
+func (wq *writeQueuer) enqueue(ri *repItem) error {
+	if err := enqueuePolicy(ri, wq.policy); err != nil {
+		return err
+	}
+	if wq.policy == QueueFail {
+		wq.policy = QueueDrop
+	}
+	return nil
+}
+
+// wait until every item queued to host for bucket before the call has
+// been sent or dropped, by passing a barrier through each of its workers
+func flushQueue(host string, bucket string, timeout time.Duration) error {
+	q := getQueue(host, bucket)
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	var barriers []chan bool
+	for _, ch := range q.workers {
+		done := make(chan bool)
+		select {
+		case ch <- &repItem{host: host, bucket: bucket, done: done}:
+		case <-t.C:
+			return errTimeout
+		}
+		barriers = append(barriers, done)
+	}
+
+	for _, done := range barriers {
+		select {
+		case <-done:
+		case <-t.C:
+			return errTimeout
+		}
+	}
+	return nil
+}
+
+// Drain waits until everything queued so far has been sent to every
+// host, or given up on, for at most timeout
+func Drain(timeout time.Duration) error {
+	queueLock.Lock()
+	qs := make([]*hostQueue, 0, len(queues))
+	for _, q := range queues {
+		qs = append(qs, q)
+	}
+	queueLock.Unlock()
+
+	errs := make(chan error, len(qs))
+	for _, q := range qs {
+		go func(q *hostQueue) {
+			if err := flushQueue(q.host, q.bucket, timeout); err != nil {
+				errs <- fmt.Errorf("%s/%s: %v", q.host, q.bucket, err)
+				return
+			}
+			errs <- nil
+		}(q)
+	}
+	var err error
+	for range qs {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (q *hostQueue) depth() int {
+	n := 0
+	for _, ch := range q.workers {
+		n += len(ch)
+	}
+	return n
+}
+
+// collect whatever is already queued, up to the batch size, and send it
+// as one pipeline
+func (q *hostQueue) drain(ch chan *repItem) {
+	batch := make([]*repItem, 0, QueueBatchSize)
+	for item := range ch {
+		if item.done != nil {
+			close(item.done)
+			continue
+		}
+
+		var barrier *repItem
+		batch = append(batch[:0], item)
+	collect:
+		for len(batch) < QueueBatchSize {
+			select {
+			case item := <-ch:
+				if item.done != nil {
+					barrier = item
+					break collect
+				}
+				batch = append(batch, item)
+			default:
+				break collect
+			}
+		}
+		q.send(batch)
+
+		if barrier != nil {
+			close(barrier.done)
+		}
+	}
+}
+
+// send a batch, retrying the failed items with exponential backoff until
+// they succeed or the retries are exhausted
+func (q *hostQueue) send(batch []*repItem) {
+	backoff := QueueRetryBackoff
+	for attempt := 0; ; attempt++ {
+		failed, superseded, err := q.sendOnce(batch)
+		atomic.AddUint64(&q.stats.Sent, uint64(len(batch)-len(failed)-superseded))
+		atomic.AddUint64(&q.stats.Superseded, uint64(superseded))
+		if len(failed) == 0 {
+			return
+		}
+
+		if attempt >= QueueMaxRetries {
+			log.Printf("Dropping %d writes to %s bucket %s after %d retries. Error %v",
+				len(failed), q.host, q.bucket, attempt, err)
+			atomic.AddUint64(&q.stats.Dropped, uint64(len(failed)))
+			return
+		}
+
+		atomic.AddUint64(&q.stats.Retried, uint64(len(failed)))
+		batch = failed
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > QueueMaxBackoff {
+			backoff = QueueMaxBackoff
+		}
+	}
+}
+
+// pipeline the batch as quiet sets and deletes followed by a noop. Only
+// failed writes get a response, so once the noop comes back every other
+// item is known to have been applied. Returns the items that need to be
+// retried and the number of failed ones that don't, as a later write to
+// their key was sent.
+func (q *hostQueue) sendOnce(batch []*repItem) ([]*repItem, int, error) {
+	pool := getPool(q.host, q.bucket)
+	cp, err := pool.GetWithTimeout(QueueConnTimeout)
+	if err != nil {
+		return batch, 0, err
+	}
+	defer pool.Return(cp)
+
+	for i, item := range batch {
+		flags := uint32(WriteProxied)
+		if item.opcode == OP_REP {
+			flags = WriteReplicated
+		}
+
+		req := &gomemcached.MCRequest{
+			Opcode: gomemcached.SETQ,
+			Key:    item.req.Key,
+			Body:   item.req.Body,
+			Extras: make([]byte, 8),
+			Opaque: uint32(i),
+		}
+		binary.BigEndian.PutUint32(req.Extras, flags)
+		if item.req.Opcode == gomemcached.DELETE {
+			req.Opcode, req.Body = gomemcached.DELETEQ, nil
+			// deletes take no extras in the memcached protocol, only
+			// luxstor nodes read the flags from them
+			if isLuxstor(q.host) {
+				req.Extras = req.Extras[:4]
+			} else {
+				req.Extras = nil
+			}
+		} else if len(item.req.Extras) >= 8 {
+			// the expiration, made absolute by the owner
+			copy(req.Extras[4:], item.req.Extras[4:8])
+		}
+		if err = cp.Transmit(req); err != nil {
+			return batch, 0, err
+		}
+	}
+
+	noop := &gomemcached.MCRequest{Opcode: gomemcached.NOOP, Opaque: uint32(len(batch))}
+	if err = cp.Transmit(noop); err != nil {
+		return batch, 0, err
+	}
+
+	failed := make([]bool, len(batch))
+	for {
+		res, rerr := cp.Receive()
+		if _, ok := rerr.(*gomemcached.MCResponse); !ok && rerr != nil {
+			return batch, 0, rerr
+		}
+		if res.Opcode == gomemcached.NOOP {
+			break
+		}
+		if int(res.Opaque) < len(batch) {
+			failed[res.Opaque] = true
+			err = fmt.Errorf("remote write failed with status %v", res.Status)
+		}
+	}
+
+	// a failed write is only retried if no later write to the same key
+	// is part of this batch, otherwise the retry would overwrite it
+	var retry []*repItem
+	superseded := 0
+	latest := make(map[string]int, len(batch))
+	for i, item := range batch {
+		latest[string(item.req.Key)] = i
+	}
+	for i, item := range batch {
+		if !failed[i] {
+			continue
+		}
+		if latest[string(item.req.Key)] == i {
+			retry = append(retry, item)
+		} else {
+			superseded++
+		}
+	}
+
+	return retry, superseded, err
+}
+
+// QueueStats returns the replication counters of every destination,
+// keyed by host/bucket
+func QueueStats() map[string]HostStats {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	stats := make(map[string]HostStats, len(queues))
+	for host, q := range queues {
+		stats[host] = HostStats{
+			Queued:     atomic.LoadUint64(&q.stats.Queued),
+			Sent:       atomic.LoadUint64(&q.stats.Sent),
+			Retried:    atomic.LoadUint64(&q.stats.Retried),
+			Dropped:    atomic.LoadUint64(&q.stats.Dropped),
+			Superseded: atomic.LoadUint64(&q.stats.Superseded),
+			Rejected:   atomic.LoadUint64(&q.stats.Rejected),
+			Depth:      q.depth(),
+		}
+	}
+	return stats
+}
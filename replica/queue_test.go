@@ -0,0 +1,152 @@
+package replica
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/server"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// a node that fails writes of the value "bad". Unless it is a luxstor
+// node it refuses deletes with extras, as memcached does
+type fakePeer struct {
+	luxstor bool
+	lock    sync.Mutex
+	got     []gomemcached.MCRequest
+}
+
+func (p *fakePeer) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.VERSION:
+		if p.luxstor {
+			return &gomemcached.MCResponse{Body: []byte("luxstor")}
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+	case gomemcached.NOOP:
+		return &gomemcached.MCResponse{}
+	}
+
+	p.lock.Lock()
+	p.got = append(p.got, *req)
+	p.lock.Unlock()
+	if string(req.Body) == "bad" || (req.Opcode == gomemcached.DELETEQ && len(req.Extras) > 0 && !p.luxstor) {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	return nil
+}
+
+func startPeer(t *testing.T, p *fakePeer) string {
+	ls, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ls.Close() })
+	go func() {
+		for {
+			c, err := ls.Accept()
+			if err != nil {
+				return
+			}
+			go memcached.HandleIO(c, p)
+		}
+	}()
+	return ls.Addr().String()
+}
+
+func TestSendBatch(t *testing.T) {
+	connPool = make(map[string]*connectionPool)
+	QueueMaxRetries = 1
+	QueueRetryBackoff = time.Millisecond
+	defer func() { QueueMaxRetries, QueueRetryBackoff = 5, 10*time.Millisecond }()
+
+	set := func(key, value string) *gomemcached.MCRequest {
+		return &gomemcached.MCRequest{Opcode: gomemcached.SET, Key: []byte(key), Body: []byte(value)}
+	}
+	del := func(key string) *gomemcached.MCRequest {
+		return &gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: []byte(key)}
+	}
+
+	tests := []struct {
+		name    string
+		luxstor bool
+		batch   []*gomemcached.MCRequest
+		want    HostStats
+	}{
+		{"all applied", true, []*gomemcached.MCRequest{set("a", "1"), set("b", "2"), del("c")},
+			HostStats{Sent: 3}},
+		{"failed and retried", true, []*gomemcached.MCRequest{set("a", "bad"), set("b", "2")},
+			HostStats{Sent: 1, Retried: 1, Dropped: 1}},
+		{"superseded by a set", true, []*gomemcached.MCRequest{set("a", "bad"), set("b", "2"), set("a", "3")},
+			HostStats{Sent: 2, Superseded: 1}},
+		{"superseded by a delete", true, []*gomemcached.MCRequest{set("a", "bad"), del("a")},
+			HostStats{Sent: 1, Superseded: 1}},
+		{"only the last write retried", true, []*gomemcached.MCRequest{set("a", "bad"), set("a", "bad")},
+			HostStats{Retried: 1, Dropped: 1, Superseded: 1}},
+		{"plain memcached peer", false, []*gomemcached.MCRequest{set("a", "1"), del("a")},
+			HostStats{Sent: 2}},
+	}
+
+	for _, test := range tests {
+		p := &fakePeer{luxstor: test.luxstor}
+		host := startPeer(t, p)
+		q := &hostQueue{host: host, bucket: client.DefaultBucket}
+
+		var batch []*repItem
+		for _, req := range test.batch {
+			batch = append(batch, &repItem{host: host, bucket: q.bucket, req: req, opcode: OP_REP})
+		}
+		q.send(batch)
+
+		if q.stats != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, q.stats, test.want)
+		}
+
+		p.lock.Lock()
+		for _, req := range p.got {
+			if req.Opcode != gomemcached.DELETEQ {
+				continue
+			}
+			if test.luxstor && (len(req.Extras) != 4 || req.Extras[3] != WriteReplicated) {
+				t.Errorf("%s: delete sent with extras %v", test.name, req.Extras)
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// a queue that is never drained, with room for n items
+func stuckQueue(host string, n int) *hostQueue {
+	q := &hostQueue{host: host, bucket: client.DefaultBucket, workers: []chan *repItem{make(chan *repItem, n)}}
+	queueLock.Lock()
+	queues[host+"/"+q.bucket] = q
+	queueLock.Unlock()
+	return q
+}
+
+// under the fail policy a write fails only if no host has taken it
+func TestWriteQueuer(t *testing.T) {
+	open, full := stuckQueue("open:1", 1), stuckQueue("full:1", 0)
+	req := &gomemcached.MCRequest{Opcode: gomemcached.SET, Key: []byte("k")}
+	item := func(q *hostQueue) *repItem {
+		return &repItem{host: q.host, bucket: q.bucket, req: req, opcode: OP_REP}
+	}
+
+	wq := &writeQueuer{policy: QueueFail}
+	if err := wq.enqueue(item(full)); err != ErrQueueFull {
+		t.Errorf("write to a full queue first: %v", err)
+	}
+	if err := wq.enqueue(item(open)); err != nil {
+		t.Errorf("write to an open queue: %v", err)
+	}
+	if err := wq.enqueue(item(full)); err != nil {
+		t.Errorf("write taken by a host failed on a full queue: %v", err)
+	}
+	if full.stats.Rejected != 1 || full.stats.Dropped != 1 || open.stats.Queued != 1 {
+		t.Errorf("full queue %+v, open queue %+v", full.stats, open.stats)
+	}
+}
@@ -0,0 +1,140 @@
+// vbucket moves during rebalance
+
+package replica
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// Time allowed for a destination to catch up with a moving vbucket, and
+// for this node to pick up the map that hands the vbucket over
+var MoveTimeout = 10 * time.Minute
+
+var ErrMoveTimeout = errors.New("timed out waiting for vbucket move")
+
+// A vbucket being copied to another node. While the destination is
+// backfilled from a snapshot every new write to the vbucket is streamed
+// to it, and keys that have been streamed are left out of the backfill
+// so an older snapshot value can't overwrite them
+type VbucketMove struct {
+	bucket   string
+	vb       int
+	dst      string
+	lock     sync.Mutex
+	streamed map[string]bool
+}
+
+type moveKey struct {
+	bucket string
+	vb     int
+}
+
+var movesLock sync.Mutex
+var moves = make(map[moveKey][]*VbucketMove)
+
+// StartMove starts streaming writes of a bucket's vbucket to dst
+func StartMove(bucket string, vb int, dst string) *VbucketMove {
+	movesLock.Lock()
+	defer movesLock.Unlock()
+
+	key := moveKey{bucket, vb}
+	for _, m := range moves[key] {
+		if m.dst == dst {
+			return m
+		}
+	}
+
+	m := &VbucketMove{bucket: bucket, vb: vb, dst: dst, streamed: make(map[string]bool)}
+	moves[key] = append(moves[key], m)
+	return m
+}
+
+// EndMove stops streaming a vbucket to dst once this node's map has dst
+// in the vbucket, from then on it is written to as owner or replica
+func EndMove(bucket string, vb int, dst string) error {
+	deadline := time.Now().Add(MoveTimeout)
+	for !inVbucket(bucket, vb, dst) {
+		if time.Now().After(deadline) {
+			AbortMove(bucket, vb, dst)
+			return ErrMoveTimeout
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	AbortMove(bucket, vb, dst)
+	return nil
+}
+
+// AbortMove stops streaming a vbucket to dst straight away, for moves that
+// failed or were given up by the cluster manager
+func AbortMove(bucket string, vb int, dst string) {
+	movesLock.Lock()
+	defer movesLock.Unlock()
+
+	key := moveKey{bucket, vb}
+	ms := moves[key]
+	for i, m := range ms {
+		if m.dst == dst {
+			moves[key] = append(ms[:i], ms[i+1:]...)
+			break
+		}
+	}
+	if len(moves[key]) == 0 {
+		delete(moves, key)
+	}
+}
+
+func inVbucket(bucket string, vb int, node string) bool {
+	for _, n := range client.VbucketNodes(client.GetBucketMap(bucket), vb) {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Backfill queues a value read from a snapshot, and its expiration, to the
+// destination
+func (m *VbucketMove) Backfill(key, value []byte, exp uint32) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.streamed[string(key)] {
+		return nil
+	}
+
+	req := &gomemcached.MCRequest{Opcode: gomemcached.SET, Key: key, Body: value, Extras: make([]byte, 8)}
+	binary.BigEndian.PutUint32(req.Extras[4:], exp)
+	return enqueue(&repItem{host: m.dst, bucket: m.bucket, req: req, opcode: OP_REP})
+}
+
+// Wait until everything queued to the destination has been sent
+func (m *VbucketMove) Wait() error {
+	return flushQueue(m.dst, m.bucket, MoveTimeout)
+}
+
+// stream a write to the destinations its vbucket is moving to
+func streamWrite(wq *writeQueuer, bucket string, req *gomemcached.MCRequest) error {
+	vb := int(findShard(string(req.Key)))
+
+	movesLock.Lock()
+	ms := append([]*VbucketMove(nil), moves[moveKey{bucket, vb}]...)
+	movesLock.Unlock()
+
+	for _, m := range ms {
+		m.lock.Lock()
+		m.streamed[string(req.Key)] = true
+		err := wq.enqueue(&repItem{host: m.dst, bucket: bucket, req: req, opcode: OP_REP})
+		m.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
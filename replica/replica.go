@@ -3,41 +3,154 @@
 package replica
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"hash/fnv"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
+	"github.com/maniktaneja/luxstor/auth"
 	"github.com/maniktaneja/luxstor/clusterclient"
 )
 
-const vbucketCount = 2
-
-var repChan chan *repItem
 var connPool map[string]*connectionPool
-var ipList []string
+var poolLock sync.Mutex
+
+// the id (host:port) of this node as it appears in the vbucket map
+var myID string
+
+// urls of the cluster managers
+var managers []string
 
 const OP_SET = 0x01
 const OP_REP = 0x02
 
-func Init(url string) {
-	repChan = make(chan *repItem, 10000000)
-	ipList = GetMyIp()
-	if len(ipList) < 1 {
-		log.Printf("Warning, iplist is empty")
-	}
+// flags a client can put in the extras of a GET
+const (
+	ReadProxied   = 0x01 // read forwarded by another node, must not be proxied again
+	ReadReplicaOK = 0x02 // the value may be read from a replica if the owner is down
+)
+
+// flags a node puts in the extras of a write it sends to another node,
+// the first 4 bytes of a set or delete and the 4 bytes after the delta,
+// initial value and expiration of an incr or decr
+const (
+	WriteReplicated = 0x01 // write sent by the owner to a replica or a move destination
+	WriteProxied    = 0x02 // write forwarded to the owner, must not be proxied again
+)
+
+// Time allowed for a request proxied to the owner of a key
+var ProxyTimeout = 5 * time.Second
+
+// Queue proxied writes instead of waiting for the owner to apply them
+var ProxyAsync = false
+
+// Proxy requests for keys owned by other nodes. When false the client is
+// sent NOT_MY_VBUCKET with the current map and is expected to retry
+var ProxyRequests = true
+
+// Connect to other nodes with TLS, presenting the node's certificate
+var TLSConfig *tls.Config
+
+// Password of the node user connections to other nodes log in with, none
+// if empty
+var NodePassword = ""
+
+// Init starts following the vbucket map published by the cluster
+// managers, a comma separated list of urls, and registers this node with
+// them under nodeID
+func Init(urls string, nodeID string) {
+	myID = nodeID
+	managers = client.ParseManagers(urls)
 	connPool = make(map[string]*connectionPool)
-	go client.RunClient(url + "/nodes")
-	go drainQueue()
+	go client.RunClient(managers)
+	go client.Register(managers, nodeID)
+}
+
+// Leave tells the cluster managers this node is going away, so its
+// vbuckets are failed over to their replicas straight away
+func Leave(timeout time.Duration) error {
+	return client.Leave(managers, myID, timeout)
+}
+
+// NodeID returns the id of this node
+func NodeID() string {
+	return myID
+}
+
+// connections to a host are pooled per bucket, each one has the bucket
+// selected
+func getPool(host string, bucket string) *connectionPool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	key := host + "/" + bucket
+	pool, ok := connPool[key]
+	if ok == false {
+		pool = newConnectionPool(host, 64, 128)
+		pool.mkConn = func(host string) (*memcached.Client, error) {
+			return bucketConn(host, bucket)
+		}
+		connPool[key] = pool
+	}
+	return pool
 }
 
-func getVbucketNode(vbid int) string {
+// connections to other nodes log in as the node user and select the
+// bucket they are for
+func bucketConn(host string, bucket string) (*memcached.Client, error) {
+	mc, err := defaultMkConn(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if NodePassword != "" {
+		if _, err = mc.AuthPlain(auth.NodeUser, NodePassword); err != nil {
+			mc.Close()
+			return nil, err
+		}
+	}
+	if bucket != client.DefaultBucket {
+		_, err = mc.Send(&gomemcached.MCRequest{Opcode: gomemcached.SELECT_BUCKET, Key: []byte(bucket)})
+		if err != nil {
+			mc.Close()
+			return nil, err
+		}
+	}
+	if _, ok := luxstorPeers.Load(host); !ok {
+		res, err := mc.Send(&gomemcached.MCRequest{Opcode: gomemcached.VERSION})
+		if _, ok := err.(*gomemcached.MCResponse); err != nil && !ok {
+			mc.Close()
+			return nil, err
+		}
+		luxstorPeers.Store(host, err == nil && strings.HasPrefix(string(res.Body), "luxstor"))
+	}
+	return mc, nil
+}
+
+// hosts that answered VERSION, true for luxstor nodes. Anything else is
+// sent plain memcached requests
+var luxstorPeers sync.Map
+
+func isLuxstor(host string) bool {
+	v, _ := luxstorPeers.Load(host)
+	return v == true
+}
+
+func getVbucketNode(bucket string, vbid int) string {
 	//log.Printf(" node id %d", vbid)
 	var vbmap string
 	//Connect to cluster manager
-	vbmap = client.GetMap()
+	vbmap = client.GetBucketMap(bucket)
 	nodes := strings.Split(vbmap, ",")
+	if vbid >= len(nodes) {
+		return ""
+	}
 	return nodes[vbid]
 }
 
@@ -48,13 +161,12 @@ func getHash(key string) uint32 {
 }
 
 func findShard(key string) uint32 {
-	vbid := getHash(key) % vbucketCount
-	return vbid
+	return client.FindShard(key)
 }
 
 func GetMyIp() []string {
 
-	ip := make([]string, 2)
+	ip := make([]string, 0, 2)
 
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
@@ -75,156 +187,246 @@ func GetMyIp() []string {
 
 type repItem struct {
 	host   string
+	bucket string
 	req    *gomemcached.MCRequest
 	opcode int
+	done   chan bool // set on barriers used to flush a queue
 }
 
-// return true if data needs to be written here
-func QueueRemoteWrite(req *gomemcached.MCRequest) {
+// queue the write to the replica of this key. An error is returned
+// when the replication queue is full and the policy is to fail writes,
+// only if no other node has been sent the write yet
+func QueueRemoteWrite(bucket string, req *gomemcached.MCRequest) error {
 
 	key := req.Key
-	nodeList := getVbucketNode(int(findShard(string(key))))
+	nodeList := getVbucketNode(bucket, int(findShard(string(key))))
 	nodes := strings.Split(nodeList, ";")
 
 	if len(nodes) < 1 {
 		log.Fatal("Nodelist is empty. Cannot proceed")
 	}
 
+	wq := &writeQueuer{policy: QueueFullPolicy}
+	if err := streamWrite(wq, bucket, req); err != nil {
+		return err
+	}
+
 	if len(nodes) < 2 {
 		//no replica
-		return
+		return nil
 	}
 
-	var remoteNode string
-	// figure out which is the remote host and queue to the write to that node
+	// queue the write to every other node holding this vbucket
 	for _, node := range nodes {
-		found := false
-		hostname := strings.Split(node, ":")
-		for _, ip := range ipList {
-			if ip == hostname[0] {
-				found = true
-				continue
-			}
+		if node == myID || node == "" {
+			continue
 		}
-		if found == false {
-			remoteNode = node
+		ri := &repItem{host: node, bucket: bucket, req: req, opcode: OP_REP}
+		if err := wq.enqueue(ri); err != nil {
+			return err
 		}
 	}
 
-	ri := &repItem{host: remoteNode, req: req, opcode: OP_REP}
-	repChan <- ri
-	return
+	return nil
 }
 
-func IsOwner(req *gomemcached.MCRequest) bool {
+// IsOwner returns true if this node is the active node of the key. Until
+// a map has been received every key is owned locally
+func IsOwner(bucket string, req *gomemcached.MCRequest) bool {
 
 	key := req.Key
-	nodeList := getVbucketNode(int(findShard(string(key))))
+	nodeList := getVbucketNode(bucket, int(findShard(string(key))))
 	nodes := strings.Split(nodeList, ";")
 
 	//log.Printf(" Nodes list %v key %s", nodes, string(key))
-	if strings.Contains(nodes[0], "localhost") || strings.Contains(nodes[0], "127.0.0.1") || nodes[0] == "" {
-		return true
-	}
+	return nodes[0] == "" || nodes[0] == myID
+}
 
-	if len(nodes) < 1 {
-		log.Fatal("Nodelist is empty. Cannot proceed")
+// Owned returns a test of whether this node owns a key under the bucket's
+// map as it is now, which keeps its answers once the map changes
+func Owned(bucket string) func(key []byte) bool {
+	vbuckets := strings.Split(client.GetBucketMap(bucket), ",")
+	return func(key []byte) bool {
+		vb := int(findShard(string(key)))
+		if vb >= len(vbuckets) {
+			return true
+		}
+		owner := strings.Split(vbuckets[vb], ";")[0]
+		return owner == "" || owner == myID
 	}
+}
 
-	for _, node := range nodes {
-		hostname := strings.Split(node, ":")
-		for _, ip := range ipList {
-			if ip == hostname[0] {
-				return true
-			}
+// IsReplica returns true if this node holds a replica of the key
+func IsReplica(bucket string, req *gomemcached.MCRequest) bool {
+
+	key := req.Key
+	nodeList := getVbucketNode(bucket, int(findShard(string(key))))
+	nodes := strings.Split(nodeList, ";")
+
+	for _, node := range nodes[1:] {
+		if node == myID {
+			return true
 		}
 	}
-
 	return false
 }
 
-// we are not the master of this node, so proxy
-func ProxyRemoteWrite(req *gomemcached.MCRequest) {
+// we are not the master of this node, so proxy. The write is forwarded
+// to the owner and its response is returned, unless ProxyAsync is set in
+// which case sets are queued and success returned straight away. Other
+// writes, such as add or incr, need the owner's answer
+func ProxyRemoteWrite(bucket string, req *gomemcached.MCRequest) *gomemcached.MCResponse {
 
 	key := req.Key
-	nodeList := getVbucketNode(int(findShard(string(key))))
+	nodeList := getVbucketNode(bucket, int(findShard(string(key))))
 	nodes := strings.Split(nodeList, ";")
 
 	if len(nodes) < 1 {
 		log.Fatal("Nodelist is empty. Cannot proceed")
 	}
 
-	ri := &repItem{host: nodes[0], req: req, opcode: OP_SET}
-	repChan <- ri
-	return
+	// the queue marks the sets it sends as proxied
+	if ProxyAsync && (req.Opcode == gomemcached.SET || req.Opcode == gomemcached.SETQ) {
+		ri := &repItem{host: nodes[0], bucket: bucket, req: req, opcode: OP_SET}
+		if err := enqueue(ri); err != nil {
+			return &gomemcached.MCResponse{Status: gomemcached.TMPFAIL}
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.SUCCESS}
+	}
+
+	fwd := &gomemcached.MCRequest{
+		Opcode:  req.Opcode,
+		VBucket: req.VBucket,
+		Cas:     req.Cas,
+		Key:     req.Key,
+		Body:    req.Body,
+	}
+	// if the owner's map disagrees it answers NOT_MY_VBUCKET instead of
+	// sending the write back
+	n := writeFlagsOffset(req)
+	fwd.Extras = make([]byte, n+4)
+	if len(req.Extras) > len(fwd.Extras) {
+		fwd.Extras = make([]byte, len(req.Extras))
+	}
+	copy(fwd.Extras, req.Extras)
+	flags := binary.BigEndian.Uint32(fwd.Extras[n:])
+	binary.BigEndian.PutUint32(fwd.Extras[n:], flags|WriteProxied)
+	// the owner would not answer a quiet write that succeeds, the caller
+	// leaves out the response itself
+	if op, ok := loudOpcodes[req.Opcode]; ok {
+		fwd.Opcode = op
+	}
+	return proxyRequest(nodes[0], bucket, fwd)
 }
 
-// we are not the master of this node, so proxy
-func ProxyRemoteRead(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+var loudOpcodes = map[gomemcached.CommandCode]gomemcached.CommandCode{
+	gomemcached.SETQ:    gomemcached.SET,
+	gomemcached.DELETEQ: gomemcached.DELETE,
+}
+
+// send a request to a remote host and wait for its response. Failure to
+// reach the host is reported as a temporary failure
+func proxyRequest(host string, bucket string, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	pool := getPool(host, bucket)
+	cp, err := pool.GetWithTimeout(ProxyTimeout)
+	if err != nil {
+		log.Printf(" Cannot get connection to %s from pool %v", host, err)
+		return &gomemcached.MCResponse{Status: gomemcached.TMPFAIL, Body: []byte(err.Error())}
+	}
+	defer pool.Return(cp)
+
+	cp.SetDeadline(time.Now().Add(ProxyTimeout))
+	res, err := cp.Send(req)
+	cp.SetDeadline(time.Time{})
+	if err != nil {
+		if r, ok := err.(*gomemcached.MCResponse); ok {
+			// the remote host returned an error status
+			return r
+		}
+		log.Printf(" Request to %s failed. Error %v", host, err)
+		return &gomemcached.MCResponse{Status: gomemcached.TMPFAIL, Body: []byte(err.Error())}
+	}
+
+	return res
+}
+
+// we are not the master of this node, so proxy. Statuses from the owner
+// are passed through, an unreachable owner is a temporary failure unless
+// the client accepts a replica read, and if the map changed while the
+// read was in flight the client is told to retry with NOT_MY_VBUCKET
+func ProxyRemoteRead(bucket string, req *gomemcached.MCRequest) *gomemcached.MCResponse {
 
 	key := req.Key
-	nodeList := getVbucketNode(int(findShard(string(key))))
+	vbid := int(findShard(string(key)))
+	nodeList := getVbucketNode(bucket, vbid)
 	nodes := strings.Split(nodeList, ";")
-	var res *gomemcached.MCResponse
 
 	if len(nodes) < 1 {
 		log.Fatal("Nodelist is empty. Cannot proceed")
 	}
 
-	pool, ok := connPool[nodes[0]]
-	if ok == false {
-		pool = newConnectionPool(nodes[0], 64, 128)
-		connPool[nodes[0]] = pool
+	flags := ReadFlags(req)
+	fwd := &gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: req.VBucket,
+		Key:     req.Key,
+		Extras:  make([]byte, 4),
 	}
 
-	cp, err := pool.Get()
-	if err != nil {
-		log.Printf(" Cannot get connection from pool %v", err)
-		// should retry or giveup TODO
-		goto done
+	binary.BigEndian.PutUint32(fwd.Extras, flags|ReadProxied)
+	res := proxyRequest(nodes[0], bucket, fwd)
+	if res.Status != gomemcached.TMPFAIL {
+		return res
 	}
 
-	res, err = cp.Get(0, string(req.Key))
-	if err != nil || res.Status != gomemcached.SUCCESS {
-		log.Printf("Set failed. Error %v", err)
-		goto done
+	if flags&ReadReplicaOK != 0 && len(nodes) > 1 {
+		log.Printf(" Owner %s of key %s unreachable, reading from replica %s",
+			nodes[0], string(key), nodes[1])
+		res = proxyRequest(nodes[1], bucket, fwd)
+		if res.Status != gomemcached.TMPFAIL {
+			return res
+		}
+	}
+
+	if getVbucketNode(bucket, vbid) != nodeList {
+		return NotMyVbucket(bucket)
 	}
-done:
-	pool.Return(cp)
 
 	return res
 }
 
-func drainQueue() {
-
-	var res *gomemcached.MCResponse
-	for item := range repChan {
-		// get connection from pool and send the data over to the
-		// remote host
-		pool, ok := connPool[item.host]
-		if ok == false {
-			pool = newConnectionPool(item.host, 64, 128)
-			connPool[item.host] = pool
-		}
+// offset of the write flags in the extras of a write
+func writeFlagsOffset(req *gomemcached.MCRequest) int {
+	switch req.Opcode {
+	case gomemcached.INCREMENT, gomemcached.INCREMENTQ, gomemcached.DECREMENT, gomemcached.DECREMENTQ:
+		return 20
+	}
+	return 0
+}
 
-		flags := 0
-		cp, err := pool.Get()
-		if err != nil {
-			log.Printf(" Cannot get connection from pool %v", err)
-			// should retry or giveup TODO
-			goto done
-		}
+// WriteFlags returns the flags in the extras of a write, 0 for a write
+// from a client
+func WriteFlags(req *gomemcached.MCRequest) uint32 {
+	n := writeFlagsOffset(req)
+	if len(req.Extras) < n+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(req.Extras[n:])
+}
 
-		if item.opcode == OP_REP {
-			flags = 1
-		}
-		res, err = cp.Set(0, string(item.req.Key), flags, 0, item.req.Body)
-		if err != nil || res.Status != gomemcached.SUCCESS {
-			log.Printf("Set failed. Error %v", err)
-			goto done
-		}
-	done:
-		pool.Return(cp)
+// ReadFlags returns the flags in the extras of a GET, if any
+func ReadFlags(req *gomemcached.MCRequest) uint32 {
+	if len(req.Extras) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(req.Extras)
+}
 
+// NotMyVbucket builds the response telling a client to go to the owner,
+// with the bucket's current map in the body
+func NotMyVbucket(bucket string) *gomemcached.MCResponse {
+	return &gomemcached.MCResponse{
+		Status: gomemcached.NOT_MY_VBUCKET,
+		Body:   []byte(client.GetBucketMap(bucket)),
 	}
 }
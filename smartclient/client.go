@@ -0,0 +1,240 @@
+// Package smartclient talks directly to the node owning a key, using the
+// vbucket map published by the cluster manager.
+package smartclient
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/couchbase/gomemcached"
+	"github.com/couchbase/gomemcached/client"
+	"github.com/maniktaneja/luxstor/clusterclient"
+)
+
+// Number of times a request is retried after NOT_MY_VBUCKET
+var MaxRetries = 3
+
+// Number of idle connections kept to each node
+var PoolSize = 8
+
+var ErrNoMap = errors.New("no vbucket map available")
+
+type Client struct {
+	managers []string
+	user     string
+	password string
+	tls      *tls.Config
+	http     *http.Client
+
+	lock  sync.RWMutex
+	vbmap string
+	pools map[string]chan *memcached.Client
+}
+
+// New creates a client and fetches the vbucket map from the cluster
+// manager at url, e.g. http://localhost:8091. Several managers can be
+// given as a comma separated list
+func New(url string) (*Client, error) {
+	return NewWithTLS(url, nil)
+}
+
+// NewWithTLS creates a client that talks to https cluster managers and to
+// the nodes over TLS using cfg
+func NewWithTLS(url string, cfg *tls.Config) (*Client, error) {
+	c := &Client{
+		managers: client.ParseManagers(url),
+		pools:    make(map[string]chan *memcached.Client),
+		tls:      cfg,
+		http:     &http.Client{Transport: &http.Transport{TLSClientConfig: cfg, Proxy: http.ProxyFromEnvironment}},
+	}
+
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh fetches the current vbucket map from the first cluster manager
+// that answers
+func (c *Client) Refresh() error {
+	err := ErrNoMap
+	for _, mgr := range c.managers {
+		if err = c.refresh(mgr); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *Client) refresh(mgrURL string) error {
+	resp, err := c.http.Get(mgrURL + "/nodes")
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	var nodes client.Map
+	if err := json.Unmarshal(body, &nodes); err != nil {
+		return err
+	}
+	if nodes.Node.LuxMap == "" {
+		return ErrNoMap
+	}
+
+	c.setMap(nodes.Node.LuxMap)
+	return nil
+}
+
+// SetAuth sets the user new connections log in as with SCRAM-SHA
+func (c *Client) SetAuth(user, password string) {
+	c.lock.Lock()
+	c.user, c.password = user, password
+	c.lock.Unlock()
+}
+
+func (c *Client) setMap(vbmap string) {
+	c.lock.Lock()
+	c.vbmap = vbmap
+	c.lock.Unlock()
+}
+
+func (c *Client) owner(key string) (string, error) {
+	c.lock.RLock()
+	vbmap := c.vbmap
+	c.lock.RUnlock()
+
+	nodes := client.VbucketNodes(vbmap, int(client.FindShard(key)))
+	if len(nodes) < 1 || nodes[0] == "" {
+		return "", ErrNoMap
+	}
+	return nodes[0], nil
+}
+
+func (c *Client) getConn(host string) (*memcached.Client, error) {
+	c.lock.Lock()
+	pool, ok := c.pools[host]
+	if !ok {
+		pool = make(chan *memcached.Client, PoolSize)
+		c.pools[host] = pool
+	}
+	user, password := c.user, c.password
+	c.lock.Unlock()
+
+	select {
+	case mc := <-pool:
+		return mc, nil
+	default:
+	}
+
+	mc, err := c.connect(host)
+	if err != nil || user == "" {
+		return mc, err
+	}
+	if _, err := mc.AuthScramSha(user, password); err != nil {
+		mc.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+func (c *Client) connect(host string) (*memcached.Client, error) {
+	if c.tls == nil {
+		return memcached.Connect("tcp", host)
+	}
+	conn, err := tls.Dial("tcp", host, c.tls)
+	if err != nil {
+		return nil, err
+	}
+	return memcached.Wrap(conn)
+}
+
+func (c *Client) returnConn(host string, mc *memcached.Client) {
+	c.lock.RLock()
+	pool := c.pools[host]
+	c.lock.RUnlock()
+
+	if !mc.IsHealthy() {
+		mc.Close()
+		return
+	}
+
+	select {
+	case pool <- mc:
+	default:
+		mc.Close()
+	}
+}
+
+// send the request to the owner of its key. On NOT_MY_VBUCKET the map in
+// the response (or a freshly fetched one) is used to retry
+func (c *Client) do(req *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+	key := string(req.Key)
+	req.VBucket = uint16(client.FindShard(key))
+
+	for attempt := 0; ; attempt++ {
+		host, err := c.owner(key)
+		if err != nil {
+			return nil, err
+		}
+
+		mc, err := c.getConn(host)
+		if err != nil {
+			return nil, err
+		}
+		res, err := mc.Send(req)
+		c.returnConn(host, mc)
+
+		if res == nil || res.Status != gomemcached.NOT_MY_VBUCKET || attempt >= MaxRetries {
+			return res, err
+		}
+
+		if len(res.Body) > 0 {
+			c.setMap(string(res.Body))
+		} else if err := c.Refresh(); err != nil {
+			return res, err
+		}
+	}
+}
+
+// Get the value of a key
+func (c *Client) Get(key string) (*gomemcached.MCResponse, error) {
+	return c.do(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte(key),
+	})
+}
+
+// Set the value of a key
+func (c *Client) Set(key string, exp int, body []byte) (*gomemcached.MCResponse, error) {
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte(key),
+		Body:   body,
+		Extras: make([]byte, 8),
+	}
+	binary.BigEndian.PutUint32(req.Extras[4:], uint32(exp))
+	return c.do(req)
+}
+
+// Close all pooled connections
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for host, pool := range c.pools {
+		close(pool)
+		for mc := range pool {
+			mc.Close()
+		}
+		delete(c.pools, host)
+	}
+}
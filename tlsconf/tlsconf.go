@@ -0,0 +1,66 @@
+// Package tlsconf builds the TLS configs of nodes, cluster managers and
+// clients from PEM files. Certificates of the cluster are signed by one
+// CA, each side checks the other's certificate against it, so nodes and
+// managers authenticate each other with mutual TLS.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Server returns the config of a listener serving certFile. With caFile
+// set, client certificates signed by the CA are verified when a client
+// presents one and rejected otherwise
+func Server(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		if cfg.ClientCAs, err = loadCA(caFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// Client returns the config of connections to servers whose certificates
+// are signed by caFile, the system roots are used if it is empty. The
+// client presents certFile when it is set
+func Client(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		var err error
+		if cfg.RootCAs, err = loadCA(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func loadCA(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates in " + caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,146 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a certificate and its key, signed by parent or self signed when
+// parent is nil
+func writeCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(file, typ string, b []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(name+".pem", "CERTIFICATE", der)
+	write(name+"-key.pem", "EC PRIVATE KEY", keyDer)
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// handshake with a server using cfg, returns the client's error
+func handshake(t *testing.T, server, client *tls.Config) error {
+	ls, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+
+	go func() {
+		conn, err := ls.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Write([]byte("ok"))
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", ls.Addr().String(), client)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// with TLS 1.3 a rejected client certificate shows up on the first read
+	_, err = conn.Read(make([]byte, 2))
+	return err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	f := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, caKey := writeCert(t, dir, "ca", true, nil, nil)
+	writeCert(t, dir, "node", false, ca, caKey)
+	writeCert(t, dir, "client", false, ca, caKey)
+	other, otherKey := writeCert(t, dir, "other-ca", true, nil, nil)
+	writeCert(t, dir, "stranger", false, other, otherKey)
+
+	server, err := Server(f("node.pem"), f("node-key.pem"), f("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mutual, err := Client(f("client.pem"), f("client-key.pem"), f("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, mutual); err != nil {
+		t.Errorf("mutual TLS failed: %v", err)
+	}
+
+	anonymous, err := Client("", "", f("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, anonymous); err != nil {
+		t.Errorf("client without a certificate rejected: %v", err)
+	}
+
+	stranger, err := Client(f("stranger.pem"), f("stranger-key.pem"), f("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// send it even though the server asks for certificates of its own CA
+	stranger.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &stranger.Certificates[0], nil
+	}
+	if err := handshake(t, server, stranger); err == nil {
+		t.Errorf("client certificate of another CA accepted")
+	}
+
+	untrusting, err := Client("", "", f("other-ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(t, server, untrusting); err == nil {
+		t.Errorf("server certificate of another CA accepted")
+	}
+}